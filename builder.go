@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type (
-	BuildHandler func(*DockerBuild)
+	BuildHandler func(context.Context, *DockerBuild)
 
 	// Builder starts up a worker for each step and builds the images
 	Builder struct {
@@ -18,10 +22,15 @@ type (
 		build  *Worker
 		upload *Worker
 		finish *Finisher
+
+		// deps tracks the base images produced in this run
+		deps *Dependencies
+		// progress reports the progress of the run, nil if disabled
+		progress *Progress
 	}
 )
 
-func NewBuilder(builder, uploader, finisher BuildHandler) *Builder {
+func NewBuilder(builder, uploader, finisher BuildHandler, progress *Progress) *Builder {
 	inputc := make(chan *DockerBuild, 128)
 	uploadc := make(chan *DockerBuild, 128)
 	finishc := make(chan *DockerBuild, 128)
@@ -51,21 +60,38 @@ func NewBuilder(builder, uploader, finisher BuildHandler) *Builder {
 	}
 
 	return &Builder{
-		parse:  parse,
-		build:  build,
-		upload: upload,
-		finish: finish,
+		parse:    parse,
+		build:    build,
+		upload:   upload,
+		finish:   finish,
+		progress: progress,
 	}
 }
 
-func (b *Builder) Run(path string) error {
+// Run builds all images in path. If ctx is canceled no new builds are
+// started, running builds are stopped and the summary is still reported.
+func (b *Builder) Run(ctx context.Context, path string) error {
+	// cancel remaining builds on failures depending on the fail mode
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	ctx, span := tracer.Start(ctx, "run")
+	defer func() { span.End(context.Cause(ctx)) }()
+	start := time.Now()
+	canceler, err := NewCanceler(ctx, cancel, c.FailMode)
+	if err != nil {
+		return err
+	}
+	b.build.canceler = canceler
+	b.upload.canceler = canceler
+	b.upload.scheduler = NewScheduler(poolSize(c.UploadPoolSize), nil, 0)
+
 	// start builders in backgroud
 	b.build.wg.Add(1)
 	b.upload.wg.Add(1)
 	b.finish.wg.Add(1)
-	go b.upload.pool(128)
-	go b.build.pool(128)
-	go b.finish.Handle()
+	go b.upload.pool(ctx)
+	go b.build.pool(ctx)
+	go b.finish.Handle(ctx)
 
 	// go to docker image folder
 	oldPath, err := os.Getwd()
@@ -77,19 +103,30 @@ func (b *Builder) Run(path string) error {
 		return fmt.Errorf("Failed to change directory to %s: %w", path, err)
 	}
 
-	changes := map[string]bool{}
+	changes := map[string][]string{}
+	buildAll := c.Dronetrigger
+	reason := "dronetrigger"
 	if !c.Dronetrigger && c.DiffOnly {
-		changes, err = diff()
-		if err != nil {
+		changes, err = diff(ctx)
+		if errors.Is(err, errNoDiffBase) {
+			log.Warnf("%s, building all images", err)
+			buildAll = true
+			reason = "no diff base"
+		} else if err != nil {
 			return fmt.Errorf("unable to diff to generate diff: %s", err)
 		}
+	} else if !c.DiffOnly {
+		reason = "diff disabled"
 	}
 	noChanges := (len(changes) == 0)
-	if noChanges {
+	if noChanges && !buildAll {
 		log.Warnf("No changes found")
 	}
 
-	// check for files
+	// check for files, all images are expanded to find dependents
+	_, parseSpan := tracer.Start(ctx, "parse")
+	builds := []*DockerBuild{}
+	selected := map[*DockerBuild]bool{}
 	err = filepath.Walk(".", func(file string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -106,27 +143,129 @@ func (b *Builder) Run(path string) error {
 		// * changed (per folder)
 		// * run by dronetrigger (rebuilds all)
 		// * no no changes found and diffonly is not set (rebuilds all)
-		_, found := changes[dir]
-		if c.Dronetrigger || (noChanges && !c.DiffOnly) {
+		// * no diff base was found (rebuilds all)
+		triggers, found := changes[dir]
+		if buildAll || (noChanges && !c.DiffOnly) {
 			found = true
 		}
-		if found {
-			err := b.parse.Parse(name)
-			if err != nil {
-				return fmt.Errorf("unable to parse file: %w", err)
+		expanded, err := b.parse.Expand(name)
+		if err != nil && found {
+			return fmt.Errorf("unable to parse file: %w", err)
+		} else if err != nil {
+			log.Warnf("Unable to parse unchanged image %s: %s", dir, err)
+			return nil
+		}
+		for _, build := range expanded {
+			selected[build] = found
+			if len(triggers) > 0 {
+				build.Reason = "changed " + strings.Join(triggers, ", ")
+			} else if found {
+				build.Reason = reason
 			}
 		}
+		builds = append(builds, expanded...)
 		return nil
 	})
+	parseSpan.End(err)
 	if err != nil {
 		return fmt.Errorf("unable to walk files: %w", err)
 	}
 
+	// * based on a selected image (per tag)
+	selectDependents(builds, selected)
+	scheduled := []*DockerBuild{}
+	for _, build := range builds {
+		if selected[build] {
+			scheduled = append(scheduled, build)
+		} else {
+			b.finish.unselected = append(b.finish.unselected, build)
+			events.EmitBuild(eventSkipped, build, &Event{Status: statusSkipped, Reason: "unchanged"})
+		}
+	}
+	expected := previousDurations(c.ResultFile)
+	if history != nil {
+		durations, err := historyDurations(ctx, history, scheduled)
+		if err != nil {
+			log.Warnf("Unable to read durations from history: %s", err)
+		}
+		for name, duration := range durations {
+			expected[name] = duration
+		}
+	}
+	b.progress.Start(expected)
+	b.deps = NewDependencies(scheduled)
+	b.build.deps = b.deps
+	b.finish.deps = b.deps
+
+	// start the longest and most important builds first
+	ranks := rankBuilds(scheduled, b.deps.Depths(), expected)
+	sortBuilds(scheduled, ranks)
+	b.build.scheduler = NewScheduler(poolSize(c.BuildPoolSize), ranks, c.FairShare)
+
+	unscheduled := []*DockerBuild{}
+	for i, build := range scheduled {
+		if ctx.Err() != nil {
+			log.Warnf("Stopped scheduling new builds: %s", context.Cause(ctx))
+			unscheduled = append(unscheduled, scheduled[i:]...)
+			break
+		}
+		if !b.parse.Schedule(ctx, build) {
+			unscheduled = append(unscheduled, build)
+		}
+	}
+
 	// wait for tasks to finish
 	b.parse.WaitAndClose()
 	b.build.WaitAndClose()
 	b.upload.WaitAndClose()
 	b.finish.Wait()
+	b.progress.Stop()
+	for _, build := range unscheduled {
+		build.Error = fmt.Errorf("not scheduled: %w", context.Cause(ctx))
+		b.finish.results = append(b.finish.results, build)
+		b.finish.emit(build)
+	}
+	b.finish.Summary()
+	counts := map[string]int{"unchanged": len(b.finish.unselected)}
+	for _, build := range b.finish.results {
+		counts[build.status()]++
+	}
+	events.Emit(&Event{
+		Type:     eventRunFinished,
+		Error:    errorText(context.Cause(ctx)),
+		Duration: time.Since(start).Seconds(),
+		Counts:   counts,
+	})
+	if c.ResultFile != "" {
+		err = b.finish.WriteResults(c.ResultFile)
+		if err != nil {
+			log.Warnf("Unable to write results: %s", err)
+		}
+	}
+	if c.JUnitFile != "" {
+		err = b.finish.WriteJUnit(c.JUnitFile)
+		if err != nil {
+			log.Warnf("Unable to write junit report: %s", err)
+		}
+	}
+	err = b.finish.WriteReports()
+	if err != nil {
+		log.Warnf("Unable to write report: %s", err)
+	}
+	if history != nil {
+		err = b.finish.RecordHistory(context.WithoutCancel(ctx), history)
+		if err != nil {
+			log.Warnf("Unable to record history: %s", err)
+		}
+	}
+
+	// remember the commit for the next diff
+	if ctx.Err() == nil && b.finish.Succeeded() {
+		err = saveSuccessfulCommit(ctx)
+		if err != nil {
+			log.Warnf("Unable to save successful commit: %s", err)
+		}
+	}
 
 	// return to old working directory, required to run tests multiple times
 	err = os.Chdir(oldPath)
@@ -134,5 +273,20 @@ func (b *Builder) Run(path string) error {
 		log.Fatalf("Failed to change directory to %s: %s", path, err)
 	}
 
+	if err := context.Cause(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("run timed out: %w", err)
+		}
+		return fmt.Errorf("run canceled: %w", err)
+	}
 	return nil
 }
+
+// poolSize returns the configured size of a pool, unset sizes fall back to
+// 128 parallel builds
+func poolSize(size int) int {
+	if size < 1 {
+		return 128
+	}
+	return size
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// failModeFast cancels the whole run on the first failure
+	failModeFast = "fast"
+	// failModeGroup cancels the builds of the same parsed matrix on the
+	// first failure
+	failModeGroup = "group"
+)
+
+// errSkipped marks builds that were not run because of another failure
+var errSkipped = errors.New("skipped")
+
+type (
+	// Canceler cancels remaining builds after a failure depending on the
+	// fail mode
+	Canceler struct {
+		mode   string
+		ctx    context.Context
+		cancel context.CancelCauseFunc
+
+		mu     sync.Mutex
+		groups map[ksuid.KSUID]*cancelGroup
+	}
+
+	// cancelGroup contains the context of all builds with the same id
+	cancelGroup struct {
+		ctx    context.Context
+		cancel context.CancelCauseFunc
+	}
+)
+
+// NewCanceler creates a canceler for the run, cancel must cancel ctx
+func NewCanceler(ctx context.Context, cancel context.CancelCauseFunc, mode string) (*Canceler, error) {
+	switch mode {
+	case "", failModeFast, failModeGroup:
+	default:
+		return nil, fmt.Errorf("unknown fail mode %q", mode)
+	}
+	return &Canceler{
+		mode:   mode,
+		ctx:    ctx,
+		cancel: cancel,
+		groups: map[ksuid.KSUID]*cancelGroup{},
+	}, nil
+}
+
+// Context returns the context for the build, in group mode it is canceled
+// with the group. ctx must be the context of the run.
+func (cn *Canceler) Context(ctx context.Context, b *DockerBuild) context.Context {
+	if cn == nil || cn.mode != failModeGroup {
+		return ctx
+	}
+	return cn.group(b.ID).ctx
+}
+
+// Failed cancels the remaining builds depending on the mode. Builds that
+// failed because of a cancellation or a timeout are ignored.
+func (cn *Canceler) Failed(b *DockerBuild) {
+	if cn == nil || b.Error == nil || errors.Is(b.Error, errSkipped) || isCanceled(b.Error) {
+		return
+	}
+	switch cn.mode {
+	case failModeFast:
+		log.Warnf("Fail-fast      %s failed, canceling all builds", b.prettyName())
+		cn.cancel(fmt.Errorf("%w: %s failed", errSkipped, b.prettyName()))
+	case failModeGroup:
+		log.Warnf("Fail-group     %s failed, canceling builds of %s", b.prettyName(), b.Name)
+		cn.group(b.ID).cancel(fmt.Errorf("%w: %s failed", errSkipped, b.prettyName()))
+	}
+}
+
+// group returns the cancel group of id, it is created if required
+func (cn *Canceler) group(id ksuid.KSUID) *cancelGroup {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	group, found := cn.groups[id]
+	if !found {
+		ctx, cancel := context.WithCancelCause(cn.ctx)
+		group = &cancelGroup{ctx: ctx, cancel: cancel}
+		cn.groups[id] = group
+	}
+	return group
+}
+
+// isCanceled checks if the error is caused by a cancellation or a timeout
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
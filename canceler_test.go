@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/ksuid"
+)
+
+// newTestCanceler creates a canceler for a new run context
+func newTestCanceler(t *testing.T, mode string) (context.Context, *Canceler) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	t.Cleanup(func() { cancel(nil) })
+	canceler, err := NewCanceler(ctx, cancel, mode)
+	if err != nil {
+		t.Fatalf("unable to create canceler: %s", err)
+	}
+	return ctx, canceler
+}
+
+func TestCancelerFast(t *testing.T) {
+	ctx, canceler := newTestCanceler(t, failModeFast)
+	php := &DockerBuild{ID: ksuid.New(), Name: "php", Tag: "8.3"}
+	node := &DockerBuild{ID: ksuid.New(), Name: "node", Tag: "22"}
+
+	// timeouts and cancellations never cancel other builds
+	php.Error = fmt.Errorf("%w: build stopped", context.DeadlineExceeded)
+	canceler.Failed(php)
+	php.Error = fmt.Errorf("build %w", context.Canceled)
+	canceler.Failed(php)
+	php.Error = fmt.Errorf("%w: dependency failed", errSkipped)
+	canceler.Failed(php)
+	if ctx.Err() != nil {
+		t.Fatalf("run canceled without a failure: %s", context.Cause(ctx))
+	}
+
+	php.Error = errors.New("exit status 1")
+	canceler.Failed(php)
+	if ctx.Err() == nil {
+		t.Fatalf("run not canceled after a failure")
+	}
+	buildCtx := canceler.Context(ctx, node)
+	if !errors.Is(context.Cause(buildCtx), errSkipped) {
+		t.Errorf("expected the other builds to be skipped, got %v", context.Cause(buildCtx))
+	}
+}
+
+func TestCancelerGroup(t *testing.T) {
+	ctx, canceler := newTestCanceler(t, failModeGroup)
+	id := ksuid.New()
+	php83 := &DockerBuild{ID: id, Name: "php", Tag: "8.3"}
+	php82 := &DockerBuild{ID: id, Name: "php", Tag: "8.2"}
+	node := &DockerBuild{ID: ksuid.New(), Name: "node", Tag: "22"}
+	php82Ctx := canceler.Context(ctx, php82)
+	nodeCtx := canceler.Context(ctx, node)
+
+	php83.Error = fmt.Errorf("%w: build stopped", context.DeadlineExceeded)
+	canceler.Failed(php83)
+	if php82Ctx.Err() != nil {
+		t.Fatalf("group canceled after a timeout: %s", context.Cause(php82Ctx))
+	}
+
+	php83.Error = errors.New("exit status 1")
+	canceler.Failed(php83)
+	if !errors.Is(context.Cause(php82Ctx), errSkipped) {
+		t.Errorf("expected php:8.2 to be skipped, got %v", context.Cause(php82Ctx))
+	}
+	if nodeCtx.Err() != nil || ctx.Err() != nil {
+		t.Errorf("other images are canceled")
+	}
+}
+
+func TestCancelerDisabled(t *testing.T) {
+	ctx, canceler := newTestCanceler(t, "")
+	b := &DockerBuild{ID: ksuid.New(), Error: errors.New("exit status 1")}
+	canceler.Failed(b)
+	if canceler.Context(ctx, b) != ctx || ctx.Err() != nil {
+		t.Errorf("builds are canceled without a fail mode")
+	}
+
+	var none *Canceler
+	none.Failed(b)
+	if none.Context(ctx, b) != ctx {
+		t.Errorf("nil canceler changed the context")
+	}
+
+	_, err := NewCanceler(ctx, func(error) {}, "slow")
+	if err == nil {
+		t.Errorf("expected an error for an unknown fail mode")
+	}
+}
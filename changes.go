@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// ImageContext describes which files can change an image
+	ImageContext struct {
+		// Dir is the image directory containing the Dockerfile
+		Dir string
+		// Context is the local build context, empty for remote contexts
+		Context    string
+		Dockerfile string
+		Ignore     *PathPatterns
+		// Watch matches files outside of the context that change the
+		// image, relative to the working directory
+		Watch *PathPatterns
+		// Sources limits the files in the context to the sources copied
+		// by the Dockerfile, nil uses the whole context
+		Sources *PathPatterns
+	}
+)
+
+// isRemoteContext checks if the build context is a git or http url
+func isRemoteContext(path string) bool {
+	return strings.Contains(path, "://") || strings.HasPrefix(path, "git@")
+}
+
+// resolveContext returns the build context of the image in dir. A local
+// `context` is relative to the image directory, `custom_path` is used as it
+// is.
+func resolveContext(dir string, m *Matrix) string {
+	switch {
+	case m.Context != "" && !isRemoteContext(m.Context) && !filepath.IsAbs(m.Context):
+		return filepath.Join(dir, m.Context)
+	case m.Context != "":
+		return m.Context
+	case m.CustomPath != "":
+		return m.CustomPath
+	}
+	return dir
+}
+
+// LoadImageContext resolves the build context and the .dockerignore of the
+// image in dir the same way the parser does
+func LoadImageContext(dir string) (*ImageContext, error) {
+	i := &ImageContext{
+		Dir:        dir,
+		Context:    dir,
+		Dockerfile: filepath.Join(dir, "Dockerfile"),
+		Watch:      &PathPatterns{},
+	}
+
+	matrixFile := filepath.Join(dir, "docker-matrix.yml")
+	if _, err := os.Stat(matrixFile); err == nil {
+		var m Matrix
+		err := loadMatrix(matrixFile, NewDockerBuild(ksuid.Nil, dir, dir), &m)
+		if err != nil {
+			return nil, err
+		}
+		i.Context = resolveContext(dir, &m)
+		if m.CustomDockerfile != "" {
+			i.Dockerfile = filepath.Join(i.Context, m.CustomDockerfile)
+		}
+		i.Watch, err = NewPathPatterns(m.WatchPaths)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if isRemoteContext(i.Context) {
+		i.Context = ""
+		i.Dockerfile = ""
+		i.Ignore = &PathPatterns{}
+		return i, nil
+	}
+	i.Context = filepath.Clean(i.Context)
+
+	// a context outside of the image directory, i.e. the repository root,
+	// only changes the image through the files the Dockerfile copies
+	if rel, err := filepath.Rel(dir, i.Context); err == nil && (rel == ".." || strings.HasPrefix(rel, "../")) {
+		sources, all, err := parseSourcesFromDockerfile(i.Dockerfile)
+		if err != nil {
+			log.Warnf("Unable to parse sources of %s, using the whole context: %s", i.Dockerfile, err)
+		}
+		if !all {
+			i.Sources, err = NewPathPatterns(sources)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ignore, err := loadIgnore(i.Context, i.Dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	i.Ignore = ignore
+	return i, nil
+}
+
+// loadIgnore loads the .dockerignore of the local build context, like
+// buildkit a Dockerfile specific ignore file takes precedence
+func loadIgnore(context, dockerfile string) (*PathPatterns, error) {
+	ignoreFile := dockerfile + ".dockerignore"
+	if _, err := os.Stat(ignoreFile); dockerfile == "" || err != nil {
+		ignoreFile = filepath.Join(context, ".dockerignore")
+	}
+	return LoadPathPatterns(ignoreFile)
+}
+
+// TriggeredBy returns the changed files that affect the image: the matrix
+// file, the Dockerfile and files in the build context that are not excluded
+// by the .dockerignore
+func (i *ImageContext) TriggeredBy(files []string) (triggers []string) {
+	for _, file := range files {
+		file = filepath.Clean(file)
+		switch {
+		case file == filepath.Join(i.Dir, "docker-matrix.yml"), file == filepath.Join(i.Dir, "Dockerfile"):
+		case i.Watch.Match(file):
+		case i.Context == "":
+			continue
+		case file == i.Dockerfile:
+		default:
+			rel, err := filepath.Rel(i.Context, file)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				continue
+			}
+			if rel != ".dockerignore" && i.Ignore.Match(rel) {
+				continue
+			}
+			if i.Sources != nil && rel != ".dockerignore" && !i.Sources.Match(rel) {
+				continue
+			}
+		}
+		triggers = append(triggers, file)
+	}
+	return triggers
+}
+
+// changedImages maps all image directories to the changed files that
+// trigger them, images without triggers are omitted
+func changedImages(files []string) (map[string][]string, error) {
+	dirs := map[string][]string{}
+	err := filepath.Walk(".", func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filepath.Base(file) != "Dockerfile" {
+			return nil
+		}
+		dir := filepath.Dir(file)
+		image, err := LoadImageContext(dir)
+		if err != nil {
+			log.Warnf("Unable to load build context of %s, using the directory: %s", dir, err)
+			image = &ImageContext{Dir: dir, Context: dir, Dockerfile: file, Ignore: &PathPatterns{}, Watch: &PathPatterns{}}
+		}
+		triggers := image.TriggeredBy(files)
+		if len(triggers) > 0 {
+			sort.Strings(triggers)
+			dirs[dir] = triggers
+			log.Infof("Changed        %s by %s", dir, strings.Join(triggers, ", "))
+		}
+		return nil
+	})
+	return dirs, err
+}
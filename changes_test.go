@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImageContextParentDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"common/entrypoint.sh": "#!/bin/sh\n",
+		"common/unused.sh":     "#!/bin/sh\n",
+		"README.md":            "# images\n",
+		"php/Dockerfile":       "FROM alpine\nCOPY common/entrypoint.sh /\n",
+		"php/docker-matrix.yml": "context: ..\n" +
+			"custom_dockerfile: php/Dockerfile\n",
+		"php/test.sh": "#!/bin/sh\n",
+	})
+	chdir(t, dir)
+
+	image, err := LoadImageContext("php")
+	if err != nil {
+		t.Fatalf("unable to load image context: %s", err)
+	}
+	if image.Context != "." || image.Dockerfile != filepath.Join("php", "Dockerfile") {
+		t.Errorf("unexpected context %q and dockerfile %q", image.Context, image.Dockerfile)
+	}
+
+	// custom_path is relative to the working directory
+	writeFiles(t, dir, map[string]string{
+		"node/Dockerfile": "FROM alpine\nCOPY common/entrypoint.sh /\n",
+		"node/docker-matrix.yml": "custom_path: .\n" +
+			"custom_dockerfile: node/Dockerfile\n",
+	})
+	node, err := LoadImageContext("node")
+	if err != nil {
+		t.Fatalf("unable to load image context: %s", err)
+	}
+	if node.Context != "." || node.Dockerfile != filepath.Join("node", "Dockerfile") {
+		t.Errorf("unexpected custom_path context %q and dockerfile %q", node.Context, node.Dockerfile)
+	}
+
+	triggers := image.TriggeredBy([]string{
+		"common/entrypoint.sh",
+		"common/unused.sh",
+		"README.md",
+		"php/docker-matrix.yml",
+		"php/test.sh",
+	})
+	want := []string{"common/entrypoint.sh", "php/docker-matrix.yml"}
+	if !reflect.DeepEqual(triggers, want) {
+		t.Errorf("want triggers %v, got %v", want, triggers)
+	}
+
+	// the parser builds the same context
+	builds, err := (&Parser{}).Expand("php")
+	if err != nil {
+		t.Fatalf("unable to expand: %s", err)
+	}
+	if builds[0].Path != "." || builds[0].Dockerfile != filepath.Join("php", "Dockerfile") {
+		t.Errorf("unexpected build context %q and dockerfile %q", builds[0].Path, builds[0].Dockerfile)
+	}
+}
+
+func TestResolveContext(t *testing.T) {
+	tests := []struct {
+		dir  string
+		m    Matrix
+		want string
+	}{
+		{"php", Matrix{}, "php"},
+		{"php", Matrix{Context: ".."}, "."},
+		{"php", Matrix{Context: "../common"}, "common"},
+		{"php", Matrix{Context: "./src/"}, "php/src"},
+		{"php", Matrix{Context: "/srv/context"}, "/srv/context"},
+		{"php", Matrix{Context: "git@github.com:example/repo.git"}, "git@github.com:example/repo.git"},
+		{"php", Matrix{Context: "src", CustomPath: "common"}, "php/src"},
+		// custom_path is used as it is, relative to the working directory
+		{"php", Matrix{CustomPath: "common"}, "common"},
+		{"php", Matrix{CustomPath: "."}, "."},
+		{"php", Matrix{CustomPath: "https://github.com/example/repo.git#main:php"}, "https://github.com/example/repo.git#main:php"},
+	}
+	for _, test := range tests {
+		if got := resolveContext(test.dir, &test.m); got != filepath.FromSlash(test.want) {
+			t.Errorf("%s with %+v: want %q, got %q", test.dir, test.m, test.want, got)
+		}
+	}
+}
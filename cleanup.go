@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modeCleanup deletes stale tags from the registry
+const modeCleanup = "cleanup"
+
+// buildIDVariable matches the variables of the TAG_BUILD_ID format
+var buildIDVariable = regexp.MustCompile(`\$(\{[^}]*\}|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// digestConcurrency limits the parallel digest lookups of a repository
+var digestConcurrency = 8
+
+type (
+	// RetentionPolicy decides which tags of a repository are deleted
+	RetentionPolicy struct {
+		// KeepBuilds is the number of build id tags kept per tag, 0
+		// keeps all
+		KeepBuilds int
+		// OrphanAge is the age after which tags that are not part of the
+		// matrix anymore are deleted, 0 keeps them
+		OrphanAge time.Duration
+		// Protected are glob patterns of tags that are never deleted
+		Protected []string
+		// buildID matches a tag with a build id suffix, the first group
+		// is the tag and the second the build id. Without a pattern no
+		// tag has a build id.
+		buildID *regexp.Regexp
+	}
+)
+
+// NewRetentionPolicy creates a retention policy, buildID is a regular
+// expression matching the build id part of a tag, i.e. `b[0-9]+`
+func NewRetentionPolicy(keepBuilds int, orphanAge time.Duration, protected []string, buildID string) (*RetentionPolicy, error) {
+	var pattern *regexp.Regexp
+	if buildID != "" {
+		var err error
+		pattern, err = regexp.Compile(fmt.Sprintf(`^(?:(.+)-)?(%s)$`, buildID))
+		if err != nil {
+			return nil, fmt.Errorf("invalid build id pattern %q: %w", buildID, err)
+		}
+	}
+	for _, glob := range protected {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid protected tag %q: %w", glob, err)
+		}
+	}
+	return &RetentionPolicy{
+		KeepBuilds: keepBuilds,
+		OrphanAge:  orphanAge,
+		Protected:  protected,
+		buildID:    pattern,
+	}, nil
+}
+
+// buildIDPattern converts the TAG_BUILD_ID format to a regular expression,
+// variables match numbers, i.e. `b${DRONE_BUILD_NUMBER}` to `b[0-9]+`
+func buildIDPattern(format string) string {
+	pattern := ""
+	for {
+		loc := buildIDVariable.FindStringIndex(format)
+		if loc == nil {
+			return pattern + regexp.QuoteMeta(format)
+		}
+		pattern += regexp.QuoteMeta(format[:loc[0]]) + "[0-9]+"
+		format = format[loc[1]:]
+	}
+}
+
+// protected checks if the tag matches a protected pattern
+func (p *RetentionPolicy) protected(tag string) bool {
+	for _, glob := range p.Protected {
+		if matched, _ := path.Match(glob, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns the tags that are deleted by the policy. current contains
+// the tags of the matrix without build id, created returns the creation time
+// of orphaned tags. Orphans whose age is unknown are kept.
+func (p *RetentionPolicy) Expired(tags []string, current map[string]bool, created func(tag string) (time.Time, error), now time.Time) (expired []string) {
+	builds := map[string][]string{}
+	orphans := []string{}
+	for _, tag := range tags {
+		if p.protected(tag) || current[tag] {
+			continue
+		}
+		if base, found := p.buildBase(tag); found && current[base] {
+			builds[base] = append(builds[base], tag)
+			continue
+		}
+		orphans = append(orphans, tag)
+	}
+
+	// keep the newest build ids per tag
+	if p.KeepBuilds > 0 {
+		for _, buildTags := range builds {
+			sort.Slice(buildTags, func(i, j int) bool {
+				return buildNumber(p.buildID, buildTags[i]) > buildNumber(p.buildID, buildTags[j])
+			})
+			if len(buildTags) > p.KeepBuilds {
+				expired = append(expired, buildTags[p.KeepBuilds:]...)
+			}
+		}
+	}
+
+	// delete old combinations that are not part of the matrix anymore
+	if p.OrphanAge > 0 {
+		for _, tag := range orphans {
+			createdAt, err := created(tag)
+			if err != nil {
+				log.Warnf("Unable to determine age of %s, keeping it: %s", tag, err)
+				continue
+			}
+			if now.Sub(createdAt) > p.OrphanAge {
+				expired = append(expired, tag)
+			}
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// buildBase returns the tag without the build id suffix, found is false if
+// the tag has no build id
+func (p *RetentionPolicy) buildBase(tag string) (base string, found bool) {
+	if p.buildID == nil {
+		return "", false
+	}
+	match := p.buildID.FindStringSubmatch(tag)
+	if match == nil {
+		return "", false
+	}
+	if match[1] == "" {
+		return "latest", true
+	}
+	return match[1], true
+}
+
+// buildNumber returns the numeric part of the build id of tag
+func buildNumber(pattern *regexp.Regexp, tag string) int {
+	match := pattern.FindStringSubmatch(tag)
+	if match == nil {
+		return -1
+	}
+	digits := strings.TrimLeftFunc(match[2], func(r rune) bool { return r < '0' || r > '9' })
+	number, err := strconv.Atoi(digits)
+	if err != nil {
+		return -1
+	}
+	return number
+}
+
+// cleanRepository deletes the expired tags of the repository and returns
+// them. Tags matching releases are current like the tags of the matrix. A
+// manifest is only deleted if no remaining tag points to it.
+func cleanRepository(ctx context.Context, policy *RetentionPolicy, host, repository string, current map[string]bool, releases *regexp.Regexp, dryRun bool) ([]string, error) {
+	tags, err := registry.Tags(ctx, host, repository)
+	if err != nil {
+		return nil, err
+	}
+	if releases != nil {
+		withReleases := map[string]bool{}
+		for tag := range current {
+			withReleases[tag] = true
+		}
+		for _, tag := range tags {
+			if releases.MatchString(tag) {
+				withReleases[tag] = true
+			}
+		}
+		current = withReleases
+	}
+	created := func(tag string) (time.Time, error) {
+		return registry.Created(ctx, Reference{Host: host, Repository: repository, Tag: tag})
+	}
+	expired := policy.Expired(tags, current, created, time.Now())
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	// deleting a manifest removes all of its tags, so digests shared with
+	// kept tags are skipped
+	isExpired := map[string]bool{}
+	for _, tag := range expired {
+		isExpired[tag] = true
+	}
+	digests, err := resolveDigests(ctx, host, repository, tags)
+	if err != nil {
+		return nil, err
+	}
+	kept := map[string]bool{}
+	for _, tag := range tags {
+		if !isExpired[tag] {
+			kept[digests[tag]] = true
+		}
+	}
+
+	deleted := []string{}
+	done := map[string]bool{}
+	for _, tag := range expired {
+		ref := fmt.Sprintf("%s/%s:%s", host, repository, tag)
+		digest := digests[tag]
+		if kept[digest] {
+			log.Infof("Keeping        %s, shares %s with a kept tag", ref, digest)
+			continue
+		}
+		deleted = append(deleted, tag)
+		if done[digest] {
+			continue
+		}
+		done[digest] = true
+		if dryRun {
+			log.Warnf("Would delete   %s (%s)", ref, digest)
+			continue
+		}
+		log.Warnf("Deleting       %s (%s)", ref, digest)
+		err := registry.Delete(ctx, Reference{Host: host, Repository: repository, Tag: digest})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// resolveDigests returns the digest of each tag, at most digestConcurrency
+// lookups run in parallel and the first error stops the remaining ones
+func resolveDigests(ctx context.Context, host, repository string, tags []string) (map[string]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	limit := make(chan struct{}, max(digestConcurrency, 1))
+	digests := make(map[string]string, len(tags))
+	var failed error
+	for _, tag := range tags {
+		if ctx.Err() != nil {
+			break
+		}
+		limit <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+			digest, err := registry.Digest(ctx, Reference{Host: host, Repository: repository, Tag: tag})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if failed == nil {
+					failed = err
+					cancel()
+				}
+				return
+			}
+			digests[tag] = digest
+		}()
+	}
+	wg.Wait()
+	if failed != nil {
+		return nil, failed
+	}
+	return digests, nil
+}
+
+// Cleanup deletes the stale tags of all repositories of the images in path.
+// The current tags are those of the default branch, the tags of other
+// events are orphans, besides the releases of git tags.
+func Cleanup(ctx context.Context, path string) error {
+	policy, err := NewRetentionPolicy(
+		c.CleanupKeepBuilds,
+		time.Duration(c.CleanupOrphanDays)*24*time.Hour,
+		c.CleanupProtected,
+		c.CleanupBuildID,
+	)
+	if err != nil {
+		return err
+	}
+	builds, err := (&Parser{}).ExpandAll(path)
+	if err != nil {
+		return err
+	}
+
+	// the current tags without build id and the release patterns per
+	// repository
+	repositories := map[string]map[string]bool{}
+	releasePatterns := map[string][]string{}
+	for _, b := range builds {
+		patterns := []string{}
+		for _, tag := range append([]string{b.Tag}, b.FloatingTags...) {
+			for _, pattern := range b.tagPolicy().ReleasePatterns(tag) {
+				patterns = append(patterns, strings.TrimPrefix(pattern, "latest-"))
+			}
+		}
+		names := map[string]bool{}
+		for _, tag := range b.tagsFor(c.Registry, "", eventDefault) {
+			ref, err := ParseReference(tag)
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("%s/%s", ref.Host, ref.Repository)
+			if repositories[name] == nil {
+				repositories[name] = map[string]bool{}
+			}
+			repositories[name][ref.Tag] = true
+			names[name] = true
+		}
+		for name := range names {
+			releasePatterns[name] = append(releasePatterns[name], patterns...)
+		}
+	}
+	names := make([]string, 0, len(repositories))
+	for name := range repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := 0
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return fmt.Errorf("cleanup canceled: %w", context.Cause(ctx))
+		}
+		host, repository, _ := strings.Cut(name, "/")
+		var releases *regexp.Regexp
+		if len(releasePatterns[name]) > 0 {
+			releases, err = regexp.Compile(fmt.Sprintf("^(?:%s)$", strings.Join(releasePatterns[name], "|")))
+			if err != nil {
+				return err
+			}
+		}
+		deleted, err := cleanRepository(ctx, policy, host, repository, repositories[name], releases, c.DryRun)
+		if err != nil {
+			failed++
+			log.Errorf("Cleanup failed %s, %s", name, err)
+			continue
+		}
+		log.Infof("Cleaned        %s, %d tags", name, len(deleted))
+	}
+	if failed > 0 {
+		return fmt.Errorf("cleanup of %d of %d repositories failed", failed, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCleanRepository(t *testing.T) {
+	fake := newFakeRegistry(t)
+	registry = NewRegistryClient(nil, nil)
+	now := time.Now()
+	old := now.Add(-60 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+
+	// current tags, the newest build shares the manifest with 8.3-alpine
+	fake.addImageAt("images/php", "8.3-alpine", "php-8.3-5", recent)
+	fake.addImageAt("images/php", "8.3-alpine-b5", "php-8.3-5", recent)
+	fake.addImageAt("images/php", "8.2-alpine", "php-8.2", old)
+	for _, build := range []string{"1", "2", "3", "4", "10"} {
+		fake.addImageAt("images/php", "8.3-alpine-b"+build, "php-8.3-"+build, old)
+	}
+	// removed from the matrix
+	fake.addImageAt("images/php", "7.4-alpine", "php-7.4", old)
+	fake.addImageAt("images/php", "7.4-alpine-b1", "php-7.4-1", old)
+	fake.addImageAt("images/php", "7.3-alpine", "php-7.3", recent)
+	fake.addImageAt("images/php", "v1.0", "php-v1", old)
+
+	policy, err := NewRetentionPolicy(2, 30*24*time.Hour, []string{"latest", "v*"}, "b?[0-9]+")
+	if err != nil {
+		t.Fatalf("unable to create policy: %s", err)
+	}
+	current := map[string]bool{"8.3-alpine": true, "8.2-alpine": true}
+	want := []string{"7.4-alpine", "7.4-alpine-b1", "8.3-alpine-b1", "8.3-alpine-b2", "8.3-alpine-b3", "8.3-alpine-b4"}
+
+	// dry run deletes nothing
+	deleted, err := cleanRepository(context.Background(), policy, fake.host(), "images/php", current, nil, true)
+	if err != nil {
+		t.Fatalf("unable to clean up: %s", err)
+	}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("dry run: want %v, got %v", want, deleted)
+	}
+	if fake.deletes != 0 {
+		t.Errorf("dry run deleted %d manifests", fake.deletes)
+	}
+
+	deleted, err = cleanRepository(context.Background(), policy, fake.host(), "images/php", current, nil, false)
+	if err != nil {
+		t.Fatalf("unable to clean up: %s", err)
+	}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("want %v, got %v", want, deleted)
+	}
+	remaining := fake.tags("images/php")
+	sort.Strings(remaining)
+	wantRemaining := []string{"7.3-alpine", "8.2-alpine", "8.3-alpine", "8.3-alpine-b10", "8.3-alpine-b5", "v1.0"}
+	if !reflect.DeepEqual(remaining, wantRemaining) {
+		t.Errorf("remaining: want %v, got %v", wantRemaining, remaining)
+	}
+}
+
+func TestCleanRepositorySharedDigest(t *testing.T) {
+	fake := newFakeRegistry(t)
+	registry = NewRegistryClient(nil, nil)
+	old := time.Now().Add(-60 * 24 * time.Hour)
+
+	// the orphan points to the same manifest as a current tag
+	fake.addImageAt("images/php", "8.3-alpine", "php-8.3", old)
+	fake.addImageAt("images/php", "8.3", "php-8.3", old)
+
+	policy, err := NewRetentionPolicy(1, 24*time.Hour, nil, "b?[0-9]+")
+	if err != nil {
+		t.Fatalf("unable to create policy: %s", err)
+	}
+	deleted, err := cleanRepository(context.Background(), policy, fake.host(), "images/php", map[string]bool{"8.3-alpine": true}, nil, false)
+	if err != nil {
+		t.Fatalf("unable to clean up: %s", err)
+	}
+	if len(deleted) != 0 || fake.deletes != 0 {
+		t.Errorf("deleted %v sharing the manifest of a kept tag", deleted)
+	}
+}
+
+func TestCleanRepositoryDigestLookups(t *testing.T) {
+	fake := newFakeRegistry(t)
+	fake.delay = 10 * time.Millisecond
+	registry = NewRegistryClient(nil, nil)
+	oldConcurrency := digestConcurrency
+	defer func() { digestConcurrency = oldConcurrency }()
+	digestConcurrency = 3
+
+	fake.addImage("images/php", "8.3-alpine", "php-8.3-12")
+	for build := 1; build <= 12; build++ {
+		fake.addImage("images/php", fmt.Sprintf("8.3-alpine-b%d", build), fmt.Sprintf("php-8.3-%d", build))
+	}
+	policy, err := NewRetentionPolicy(2, 0, nil, "b?[0-9]+")
+	if err != nil {
+		t.Fatalf("unable to create policy: %s", err)
+	}
+	deleted, err := cleanRepository(context.Background(), policy, fake.host(), "images/php", map[string]bool{"8.3-alpine": true}, nil, true)
+	if err != nil {
+		t.Fatalf("unable to clean up: %s", err)
+	}
+	if len(deleted) != 10 {
+		t.Errorf("want 10 expired builds, got %v", deleted)
+	}
+
+	// every tag is looked up once, with limited parallel requests
+	if fake.heads != 13 {
+		t.Errorf("want 13 digest lookups, got %d", fake.heads)
+	}
+	if fake.maxHeads < 2 || fake.maxHeads > digestConcurrency {
+		t.Errorf("want at most %d parallel lookups, got %d", digestConcurrency, fake.maxHeads)
+	}
+}
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-60 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+	created := map[string]time.Time{
+		"node-14": recent, "node-12": old, "node-b3": old, "node-b4": old,
+		"node-16-b7": old, "node-16-b8": old, "16-b2": old, "b5": old,
+	}
+	tags := []string{"node", "node-16", "node-18", "node-14", "node-12", "node-b3", "node-b4", "node-16-b7", "node-16-b8", "16", "16-b2", "latest", "b5"}
+	current := map[string]bool{"node": true, "node-16": true, "node-18": true, "16": true, "latest": true}
+
+	tests := []struct {
+		buildID string
+		want    []string
+	}{
+		// numeric matrix tags are not build ids of the shorter tag, the
+		// recent node-14 is an orphan and kept
+		{"b[0-9]+", []string{"node-12", "node-16-b7", "node-b3"}},
+		// without build ids all other tags are orphans
+		{"", []string{"16-b2", "b5", "node-12", "node-16-b7", "node-16-b8", "node-b3", "node-b4"}},
+	}
+	for _, test := range tests {
+		policy, err := NewRetentionPolicy(1, 30*24*time.Hour, nil, test.buildID)
+		if err != nil {
+			t.Fatalf("unable to create policy: %s", err)
+		}
+		expired := policy.Expired(tags, current, func(tag string) (time.Time, error) {
+			return created[tag], nil
+		}, now)
+		if !reflect.DeepEqual(expired, test.want) {
+			t.Errorf("%q: want %v, got %v", test.buildID, test.want, expired)
+		}
+	}
+}
+
+func TestBuildIDPattern(t *testing.T) {
+	tests := map[string]string{
+		"b${DRONE_BUILD_NUMBER}":       "b[0-9]+",
+		"$DRONE_BUILD_NUMBER":          "[0-9]+",
+		"build.${DRONE_BUILD_NUMBER}x": `build\.[0-9]+x`,
+		"${A}-${B}":                    "[0-9]+-[0-9]+",
+		"b1":                           "b1",
+		"":                             "",
+	}
+	for format, want := range tests {
+		if got := buildIDPattern(format); got != want {
+			t.Errorf("%q: want %q, got %q", format, want, got)
+		}
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	fake := newFakeRegistry(t)
+	registry = NewRegistryClient(nil, nil)
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"node/Dockerfile":        "FROM alpine\n",
+		"node/docker-matrix.yml": "multiply:\n  VERSION: [\"16\", \"18\"]\n",
+	})
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{
+		Registry:          fake.host(),
+		DefaultNamespace:  "images",
+		TagName:           "latest",
+		TagPolicy:         defaultTagPolicy(t),
+		CleanupKeepBuilds: 1,
+		CleanupOrphanDays: 30,
+		CleanupProtected:  []string{"latest"},
+		CleanupBuildID:    buildIDPattern("b${DRONE_BUILD_NUMBER}"),
+	}
+	// the cleanup runs on a branch, its tags are not current
+	setDroneEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT": "push",
+		"DRONE_BRANCH":      "feature/x",
+		"DRONE_REPO_BRANCH": "main",
+	})
+
+	for tag, content := range map[string]string{
+		"16": "16-2", "16-b2": "16-2", "16-b1": "16-1", "18": "18",
+		"16-1.2.0": "16-release", "16-1.2.0-b1": "16-release",
+		"16-feature-x": "16-branch", "14": "14",
+	} {
+		fake.addImageAt("images/node", tag, content, old)
+	}
+
+	err := Cleanup(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("unable to clean up: %s", err)
+	}
+	remaining := fake.tags("images/node")
+	sort.Strings(remaining)
+	want := []string{"16", "16-1.2.0", "16-1.2.0-b1", "16-b2", "18"}
+	if !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining: want %v, got %v", want, remaining)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	dockerfileContinuation = regexp.MustCompile(`\\[ \t]*\r?\n`)
+	dockerfileInstruction  = regexp.MustCompile(`(?im)^[ \t]*(ARG|FROM)[ \t]+(.*)$`)
+	dockerfileVariable     = regexp.MustCompile(`\$(\{([A-Za-z_][A-Za-z0-9_]*)(:?-([^}]*))?\}|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+type (
+	// dockerStage is a FROM statement of a Dockerfile
+	dockerStage struct {
+		// Image is the base image or stage with all arguments substituted
+		Image string
+		// Name is the lowercase stage name, empty if unnamed
+		Name string
+	}
+
+	// Dependencies tracks which scheduled builds produce the images other
+	// scheduled builds are based on
+	Dependencies struct {
+		mu     sync.Mutex
+		builds []*DockerBuild
+		// parents are the scheduled builds producing the base images of
+		// each build
+		parents map[*DockerBuild][]*DockerBuild
+		// cycles are the errors of builds based on each other
+		cycles map[*DockerBuild]error
+		done   map[*DockerBuild]chan struct{}
+	}
+)
+
+// NewDependencies creates a dependency tracker for the scheduled builds.
+// Builds that are based on each other would wait forever, they fail up
+// front. A build based on its own tag uses the previously pushed image and
+// does not wait.
+func NewDependencies(builds []*DockerBuild) *Dependencies {
+	d := &Dependencies{
+		builds:  builds,
+		parents: map[*DockerBuild][]*DockerBuild{},
+		cycles:  map[*DockerBuild]error{},
+		done:    map[*DockerBuild]chan struct{}{},
+	}
+	producers := map[string][]*DockerBuild{}
+	for _, b := range builds {
+		d.done[b] = make(chan struct{})
+		for _, ref := range producedRefs(b) {
+			producers[ref] = append(producers[ref], b)
+		}
+	}
+	for _, b := range builds {
+		seen := map[*DockerBuild]bool{b: true}
+		for _, ref := range resolveFroms(b) {
+			for _, producer := range producers[ref] {
+				if !seen[producer] {
+					seen[producer] = true
+					d.parents[b] = append(d.parents[b], producer)
+				}
+			}
+		}
+	}
+	for _, cycle := range d.findCycles() {
+		names := make([]string, 0, len(cycle))
+		for _, b := range cycle {
+			names = append(names, b.prettyName())
+		}
+		sort.Strings(names)
+		err := fmt.Errorf("dependency cycle between %s", strings.Join(names, ", "))
+		log.Errorf("Cycle          %s are based on each other", strings.Join(names, ", "))
+		for _, b := range cycle {
+			d.cycles[b] = err
+		}
+	}
+	return d
+}
+
+// findCycles returns the groups of builds that are based on each other,
+// the strongly connected components of the parents with more than one build
+func (d *Dependencies) findCycles() (cycles [][]*DockerBuild) {
+	index := map[*DockerBuild]int{}
+	low := map[*DockerBuild]int{}
+	onStack := map[*DockerBuild]bool{}
+	stack := []*DockerBuild{}
+
+	var connect func(b *DockerBuild)
+	connect = func(b *DockerBuild) {
+		index[b] = len(index)
+		low[b] = index[b]
+		stack = append(stack, b)
+		onStack[b] = true
+		for _, parent := range d.parents[b] {
+			if _, visited := index[parent]; !visited {
+				connect(parent)
+				low[b] = min(low[b], low[parent])
+			} else if onStack[parent] {
+				low[b] = min(low[b], index[parent])
+			}
+		}
+		if low[b] != index[b] {
+			return
+		}
+		component := []*DockerBuild{}
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == b {
+				break
+			}
+		}
+		if len(component) > 1 {
+			cycles = append(cycles, component)
+		}
+	}
+	for _, b := range d.builds {
+		if _, visited := index[b]; !visited {
+			connect(b)
+		}
+	}
+	return cycles
+}
+
+// Wait blocks until all builds producing base images of b are finished. If
+// one of them failed b is skipped, builds in a cycle fail immediately.
+func (d *Dependencies) Wait(ctx context.Context, b *DockerBuild) error {
+	if d == nil {
+		return nil
+	}
+	if err := d.cycles[b]; err != nil {
+		return err
+	}
+	for _, producer := range d.parents[b] {
+		d.mu.Lock()
+		done, found := d.done[producer]
+		d.mu.Unlock()
+		if found {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-done:
+			}
+		}
+		if producer.Error != nil {
+			return fmt.Errorf("%w: dependency %s failed", errSkipped, producer.prettyName())
+		}
+	}
+	return nil
+}
+
+// Done marks the build as finished
+func (d *Dependencies) Done(b *DockerBuild) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if done, found := d.done[b]; found {
+		close(done)
+		delete(d.done, b)
+	}
+}
+
+// Depths returns the number of levels of scheduled builds that are based on
+// each build, 0 if no scheduled build is based on it
+func (d *Dependencies) Depths() map[*DockerBuild]int {
+	dependents := map[*DockerBuild][]*DockerBuild{}
+	for _, b := range d.builds {
+		for _, parent := range d.parents[b] {
+			dependents[parent] = append(dependents[parent], b)
+		}
+	}
+
+	depths := map[*DockerBuild]int{}
+	visiting := map[*DockerBuild]bool{}
+	var depth func(b *DockerBuild) int
+	depth = func(b *DockerBuild) int {
+		if result, found := depths[b]; found {
+			return result
+		}
+		// cycles are broken, the builds fail anyway
+		if visiting[b] {
+			return 0
+		}
+		visiting[b] = true
+		result := 0
+		for _, dependent := range dependents[b] {
+			if next := depth(dependent) + 1; next > result {
+				result = next
+			}
+		}
+		depths[b] = result
+		return result
+	}
+	for _, b := range d.builds {
+		depth(b)
+	}
+	return depths
+}
+
+// selectDependents extends the selected builds with all builds that are
+// based on an image produced by a selected build, transitively. Only the
+// exact tags are taken into account.
+func selectDependents(builds []*DockerBuild, selected map[*DockerBuild]bool) {
+	producers := map[string]*DockerBuild{}
+	for _, b := range builds {
+		for _, ref := range producedRefs(b) {
+			producers[ref] = b
+		}
+	}
+
+	froms := map[*DockerBuild][]string{}
+	for _, b := range builds {
+		froms[b] = resolveFroms(b)
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, b := range builds {
+			if selected[b] {
+				continue
+			}
+			for _, ref := range froms[b] {
+				producer, found := producers[ref]
+				if found && selected[producer] {
+					log.Infof("Dependent      %s is based on %s", b.prettyName(), ref)
+					b.Reason = "based on " + ref
+					selected[b] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// producedRefs returns the normalized references of all tags of the build
+func producedRefs(b *DockerBuild) (refs []string) {
+	for _, tag := range b.tags() {
+		ref, err := ParseReference(tag)
+		if err == nil {
+			refs = append(refs, ref.String())
+		}
+	}
+	return refs
+}
+
+// resolveFroms returns the normalized references of all FROM statements
+// with the build arguments and the global ARG defaults substituted. Stage
+// names, scratch and digests are skipped.
+func resolveFroms(b *DockerBuild) (refs []string) {
+	names := map[string]bool{"scratch": true}
+	for _, stage := range parseStages(b) {
+		image := stage.Image
+		if stage.Name != "" {
+			names[stage.Name] = true
+		}
+		if names[strings.ToLower(image)] || strings.Contains(image, "@") {
+			continue
+		}
+		ref, err := ParseReference(image)
+		if err == nil {
+			refs = append(refs, ref.String())
+		}
+	}
+	return refs
+}
+
+// parseStages returns the FROM statements of the Dockerfile with the build
+// arguments and the global ARG defaults substituted
+func parseStages(b *DockerBuild) (stages []dockerStage) {
+	dockerfile, err := os.ReadFile(b.Dockerfile)
+	if err != nil {
+		return nil
+	}
+	content := dockerfileContinuation.ReplaceAllString(string(dockerfile), " ")
+
+	args := map[string]string{}
+	inStage := false
+	for _, match := range dockerfileInstruction.FindAllStringSubmatch(content, -1) {
+		fields := strings.Fields(match[2])
+		if strings.EqualFold(match[1], "ARG") {
+			// only global arguments before the first FROM are available
+			if inStage {
+				continue
+			}
+			for _, field := range fields {
+				name, value, _ := strings.Cut(field, "=")
+				args[name] = strings.Trim(value, `"'`)
+				if arg, found := b.Arguments[name]; found && arg != "" {
+					args[name] = arg
+				}
+			}
+			continue
+		}
+
+		inStage = true
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		stage := dockerStage{Image: substituteArgs(fields[0], args)}
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stage.Name = strings.ToLower(fields[2])
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// substituteArgs replaces `$NAME`, `${NAME}` and `${NAME:-default}` with the
+// argument values
+func substituteArgs(text string, args map[string]string) string {
+	return dockerfileVariable.ReplaceAllStringFunc(text, func(variable string) string {
+		match := dockerfileVariable.FindStringSubmatch(variable)
+		name := match[2]
+		if name == "" {
+			name = match[5]
+		}
+		value, found := args[name]
+		if match[3] != "" && (!found || value == "" && strings.HasPrefix(match[3], ":")) {
+			return match[4]
+		}
+		return value
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dependencyBuild creates a build of `registry.example.com/images/<name>`
+// with the Dockerfile
+func dependencyBuild(t *testing.T, name, tag, dockerfile string) *DockerBuild {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"Dockerfile": dockerfile})
+	return &DockerBuild{
+		Namespace:  "images",
+		Name:       name,
+		Tag:        tag,
+		Path:       dir,
+		Dockerfile: filepath.Join(dir, "Dockerfile"),
+		Arguments:  map[string]string{},
+	}
+}
+
+// setDependencyConfig configures the registry of dependencyBuild for the
+// default event
+func setDependencyConfig(t *testing.T) {
+	oldConfig := c
+	t.Cleanup(func() { c = oldConfig })
+	c = config{Registry: "registry.example.com"}
+	for _, env := range []string{"DRONE_BUILD_EVENT", "DRONE_PULL_REQUEST", "DRONE_TAG", "DRONE_BRANCH"} {
+		t.Setenv(env, "")
+	}
+}
+
+// normalized returns the normalized references
+func normalized(t *testing.T, images ...string) []string {
+	refs := []string{}
+	for _, image := range images {
+		ref, err := ParseReference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref.String())
+	}
+	return refs
+}
+
+func TestResolveFroms(t *testing.T) {
+	setDependencyConfig(t)
+	b := dependencyBuild(t, "php", "8.3", strings.Join([]string{
+		"ARG BASE=3.20",
+		"ARG REGISTRY=registry.example.com",
+		"ARG NODE",
+		"FROM --platform=$BUILDPLATFORM ${REGISTRY}/images/base:${BASE} AS Build",
+		"ARG BASE=ignored",
+		"FROM build",
+		"FROM scratch",
+		"FROM alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		"FROM \\",
+		"  node:${NODE:-22}",
+	}, "\n"))
+
+	want := normalized(t, "registry.example.com/images/base:3.20", "node:22")
+	if got := resolveFroms(b); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	b.Arguments["BASE"] = "3.19"
+	b.Arguments["NODE"] = "20"
+	b.Arguments["UNDECLARED"] = "1"
+	want = normalized(t, "registry.example.com/images/base:3.19", "node:20")
+	if got := resolveFroms(b); !reflect.DeepEqual(got, want) {
+		t.Errorf("with arguments: want %v, got %v", want, got)
+	}
+}
+
+func TestSelectDependents(t *testing.T) {
+	setDependencyConfig(t)
+	base := dependencyBuild(t, "base", "3.20", "FROM alpine:3.20\n")
+	php := dependencyBuild(t, "php", "8.3", "FROM registry.example.com/images/base:3.20\n")
+	app := dependencyBuild(t, "app", "latest", "FROM registry.example.com/images/php:8.3\n")
+	other := dependencyBuild(t, "other", "latest", "FROM registry.example.com/images/base:3.19\n")
+	builds := []*DockerBuild{app, php, base, other}
+
+	selected := map[*DockerBuild]bool{base: true}
+	selectDependents(builds, selected)
+	want := map[*DockerBuild]bool{base: true, php: true, app: true}
+	if !reflect.DeepEqual(selected, want) {
+		t.Errorf("unexpected selection, other: %t, php: %t, app: %t", selected[other], selected[php], selected[app])
+	}
+	if php.Reason != "based on "+normalized(t, "registry.example.com/images/base:3.20")[0] {
+		t.Errorf("unexpected reason %q", php.Reason)
+	}
+
+	depths := NewDependencies(builds).Depths()
+	wantDepths := map[*DockerBuild]int{base: 2, php: 1, app: 0, other: 0}
+	if !reflect.DeepEqual(depths, wantDepths) {
+		t.Errorf("unexpected depths %v", depths)
+	}
+}
+
+// waitResult waits for the dependencies of b in the background
+func waitResult(ctx context.Context, d *Dependencies, b *DockerBuild) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- d.Wait(ctx, b) }()
+	return result
+}
+
+func TestDependenciesWait(t *testing.T) {
+	setDependencyConfig(t)
+	ctx := context.Background()
+	base := dependencyBuild(t, "base", "3.20", "FROM alpine:3.20\n")
+	php := dependencyBuild(t, "php", "8.3", "FROM registry.example.com/images/base:3.20\n")
+	node := dependencyBuild(t, "node", "22", "FROM registry.example.com/images/base:3.20\n")
+	self := dependencyBuild(t, "self", "1", "FROM registry.example.com/images/self:1\n")
+	d := NewDependencies([]*DockerBuild{base, php, node, self})
+
+	// a build based on its own tag uses the pushed image
+	select {
+	case err := <-waitResult(ctx, d, self):
+		if err != nil {
+			t.Errorf("self reference: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("a build based on its own tag waits for itself")
+	}
+
+	phpResult := waitResult(ctx, d, php)
+	select {
+	case err := <-phpResult:
+		t.Fatalf("php did not wait for its base: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	d.Done(base)
+	if err := <-phpResult; err != nil {
+		t.Errorf("unexpected error after the base succeeded: %s", err)
+	}
+	if err := d.Wait(ctx, node); err != nil {
+		t.Errorf("unexpected error of a finished base: %s", err)
+	}
+
+	// a failed base skips the builds based on it
+	base.Error = errors.New("exit status 1")
+	if err := d.Wait(ctx, node); !errors.Is(err, errSkipped) {
+		t.Errorf("expected node to be skipped, got %v", err)
+	}
+
+	// a canceled run stops waiting
+	waiting := NewDependencies([]*DockerBuild{base, php})
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := waiting.Wait(canceled, php); err != nil {
+		t.Errorf("unexpected error after cancel: %s", err)
+	}
+}
+
+func TestDependenciesCycle(t *testing.T) {
+	setDependencyConfig(t)
+	a := dependencyBuild(t, "a", "1", "FROM registry.example.com/images/b:1\n")
+	b := dependencyBuild(t, "b", "1", "FROM registry.example.com/images/a:1\n")
+	// two builds producing the same tag from it are a cycle as well
+	c1 := dependencyBuild(t, "c", "1", "FROM registry.example.com/images/c:1\n")
+	c2 := dependencyBuild(t, "c", "1", "FROM registry.example.com/images/c:1\n")
+	dependent := dependencyBuild(t, "dependent", "1", "FROM registry.example.com/images/a:1\n")
+	d := NewDependencies([]*DockerBuild{dependent, a, b, c1, c2})
+
+	for _, build := range []*DockerBuild{a, b, c1, c2} {
+		select {
+		case err := <-waitResult(context.Background(), d, build):
+			if err == nil || !strings.Contains(err.Error(), "dependency cycle") || errors.Is(err, errSkipped) {
+				t.Errorf("%s: expected a cycle failure, got %v", build.prettyName(), err)
+			}
+			build.Error = err
+			d.Done(build)
+		case <-time.After(time.Second):
+			t.Fatalf("%s waits forever", build.prettyName())
+		}
+	}
+	if err := d.Wait(context.Background(), dependent); !errors.Is(err, errSkipped) {
+		t.Errorf("expected the dependent of the cycle to be skipped, got %v", err)
+	}
+}
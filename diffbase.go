@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// diffModeLastSuccess diffs against the commit of the last successful
+	// run
+	diffModeLastSuccess = "last-success"
+
+	// vcsRefLabel stores the commit an image was built from, before the
+	// OCI revision label
+	vcsRefLabel = "org.label-schema.vcs-ref"
+)
+
+// errNoDiffBase is returned if no commit to diff against could be found
+var errNoDiffBase = errors.New("unable to determine diff base")
+
+// commitSHAPattern matches full sha1 and sha256 commit ids
+var commitSHAPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// isCommitSHA checks if value is a full commit id, refs like
+// `refs/heads/master` always resolve to the current commit and are no diff
+// base
+func isCommitSHA(value string) bool {
+	return commitSHAPattern.MatchString(value)
+}
+
+// git runs a git command and returns the trimmed output
+func git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// commitExists checks if ref is a commit in the local history
+func commitExists(ctx context.Context, ref string) bool {
+	_, err := git(ctx, "cat-file", "-e", ref+"^{commit}")
+	return err == nil
+}
+
+// diffBase determines the commit to diff against:
+//
+//   - DIFF_BASE if set
+//   - the last successful run in DIFF_MODE last-success
+//   - the merge-base with the target branch for pull requests
+//   - DRONE_COMMIT_BEFORE for pushes, if it is part of the history
+//   - the merge-base with the default branch otherwise
+func diffBase(ctx context.Context) (string, error) {
+	if c.DiffBase != "" {
+		return c.DiffBase, nil
+	}
+
+	if c.DiffMode == diffModeLastSuccess {
+		base, err := lastSuccessfulCommit(ctx)
+		if err == nil {
+			return base, nil
+		}
+		log.Warnf("Unable to find last successful run, falling back: %s", err)
+	} else if c.DiffMode != "" {
+		return "", fmt.Errorf("unknown diff mode %q", c.DiffMode)
+	}
+
+	ref := os.Getenv("DRONE_COMMIT_REF")
+	if strings.HasPrefix(ref, "refs/pull/") || os.Getenv("DRONE_BUILD_EVENT") == "pull_request" {
+		target := os.Getenv("DRONE_TARGET_BRANCH")
+		if target == "" {
+			target = defaultBranch()
+		}
+		return mergeBase(ctx, target)
+	}
+
+	before := strings.TrimPrefix(os.Getenv("DRONE_COMMIT_BEFORE"), "refs/")
+	if before != "" && strings.Trim(before, "0") != "" && commitExists(ctx, before) {
+		return before, nil
+	}
+	log.Warnf("Previous commit %q is not part of the history, i.e. first or forced push", before)
+	return mergeBase(ctx, defaultBranch())
+}
+
+// defaultBranch returns the configured default branch
+func defaultBranch() string {
+	if c.DefaultBranch != "" {
+		return c.DefaultBranch
+	}
+	if branch := os.Getenv("DRONE_REPO_BRANCH"); branch != "" {
+		return branch
+	}
+	return "master"
+}
+
+// mergeBase returns the merge-base of HEAD and branch. If HEAD is part of
+// branch the previous commit is used.
+func mergeBase(ctx context.Context, branch string) (string, error) {
+	for _, candidate := range []string{"origin/" + branch, branch} {
+		if !commitExists(ctx, candidate) {
+			continue
+		}
+		base, err := git(ctx, "merge-base", "HEAD", candidate)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", errNoDiffBase, err)
+		}
+		head, err := git(ctx, "rev-parse", "HEAD")
+		if err == nil && head == base && commitExists(ctx, "HEAD^") {
+			return "HEAD^", nil
+		}
+		return base, nil
+	}
+	return "", fmt.Errorf("%w: branch %s not found", errNoDiffBase, branch)
+}
+
+// lastSuccessfulCommit reads the commit of the last successful run from the
+// state file or from the revision label of a published image
+func lastSuccessfulCommit(ctx context.Context) (string, error) {
+	if c.DiffStateFile != "" {
+		state, err := os.ReadFile(c.DiffStateFile)
+		if err == nil {
+			commit := strings.TrimSpace(string(state))
+			if isCommitSHA(commit) && commitExists(ctx, commit) {
+				return commit, nil
+			}
+			log.Warnf("Commit %q from %s is no commit sha or not part of the history", commit, c.DiffStateFile)
+		} else if !os.IsNotExist(err) {
+			return "", fmt.Errorf("unable to read diff state: %w", err)
+		}
+	}
+
+	if c.DiffStateImage != "" {
+		ref, err := ParseReference(c.DiffStateImage)
+		if err != nil {
+			return "", err
+		}
+		labels, err := registry.Labels(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+		commit := labelCommit(labels)
+		if commit == "" {
+			return "", fmt.Errorf("%s has no commit sha in %s or %s", ref, revisionLabel, vcsRefLabel)
+		}
+		if commitExists(ctx, commit) {
+			return commit, nil
+		}
+		return "", fmt.Errorf("revision %q of %s is not part of the history", commit, ref)
+	}
+
+	return "", fmt.Errorf("no previous successful run recorded")
+}
+
+// labelCommit returns the commit of the revision labels of an image, empty
+// if none of them is a commit sha
+func labelCommit(labels map[string]string) string {
+	for _, label := range []string{revisionLabel, vcsRefLabel} {
+		if isCommitSHA(labels[label]) {
+			return labels[label]
+		}
+	}
+	return ""
+}
+
+// saveSuccessfulCommit records HEAD as the commit of the last successful run
+func saveSuccessfulCommit(ctx context.Context) error {
+	if c.DiffStateFile == "" {
+		return nil
+	}
+	head, err := git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.DiffStateFile, []byte(head+"\n"))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLabelCommit(t *testing.T) {
+	sha := "279d9035886d4c0427549863c4c2101e4a63e041"
+	tests := []struct {
+		labels map[string]string
+		want   string
+	}{
+		{map[string]string{revisionLabel: sha, vcsRefLabel: "refs/heads/master"}, sha},
+		{map[string]string{revisionLabel: "refs/heads/master", vcsRefLabel: sha}, sha},
+		{map[string]string{vcsRefLabel: "refs/heads/master"}, ""},
+		{map[string]string{revisionLabel: "279d903"}, ""},
+		{map[string]string{}, ""},
+	}
+	for _, test := range tests {
+		if got := labelCommit(test.labels); got != test.want {
+			t.Errorf("%v: want %q, got %q", test.labels, test.want, got)
+		}
+	}
+}
+
+func TestLastSuccessfulCommit(t *testing.T) {
+	ctx := context.Background()
+	head, err := git(ctx, "rev-parse", "HEAD")
+	if err != nil {
+		t.Skipf("no git history: %s", err)
+	}
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c.DiffStateImage = ""
+	c.DiffStateFile = filepath.Join(t.TempDir(), "last-success")
+
+	tests := []struct {
+		state string
+		want  string
+	}{
+		{head + "\n", head},
+		// refs resolve to HEAD, the diff would always be empty
+		{"HEAD\n", ""},
+		{"refs/heads/master\n", ""},
+		{"0000000000000000000000000000000000000000\n", ""},
+	}
+	for _, test := range tests {
+		err := os.WriteFile(c.DiffStateFile, []byte(test.state), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := lastSuccessfulCommit(ctx)
+		if got != test.want || (test.want == "") != (err != nil) {
+			t.Errorf("%q: want %q, got %q (%v)", test.state, test.want, got, err)
+		}
+	}
+}
+
+// gitRepo creates a git repository in a temp dir and changes into it
+func gitRepo(t *testing.T, branch string) {
+	chdir(t, t.TempDir())
+	for _, args := range [][]string{
+		{"init", "-q", "-b", branch},
+		{"config", "user.email", "ci@example.com"},
+		{"config", "user.name", "ci"},
+		{"config", "commit.gpgsign", "false"},
+	} {
+		gitRun(t, args...)
+	}
+}
+
+// gitRun runs a git command in the working directory
+func gitRun(t *testing.T, args ...string) string {
+	out, err := git(context.Background(), args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// gitCommit commits files and returns the commit sha
+func gitCommit(t *testing.T, files map[string]string) string {
+	writeFiles(t, ".", files)
+	gitRun(t, "add", "-A")
+	gitRun(t, "commit", "-qm", "update")
+	return gitRun(t, "rev-parse", "HEAD")
+}
+
+// setDiffEnv sets the drone variables used to find the diff base
+func setDiffEnv(t *testing.T, event, ref, before, target string) {
+	t.Setenv("DRONE_BUILD_EVENT", event)
+	t.Setenv("DRONE_COMMIT_REF", ref)
+	t.Setenv("DRONE_COMMIT_BEFORE", before)
+	t.Setenv("DRONE_TARGET_BRANCH", target)
+	t.Setenv("DRONE_REPO_BRANCH", "")
+}
+
+func TestDiffBasePullRequest(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{}
+	gitRepo(t, "main")
+	base := gitCommit(t, map[string]string{"php/Dockerfile": "FROM php\n"})
+	gitRun(t, "checkout", "-qb", "feature")
+	feature := gitCommit(t, map[string]string{"php/Dockerfile": "FROM php:8.3\n"})
+	gitRun(t, "checkout", "-q", "main")
+	gitCommit(t, map[string]string{"node/Dockerfile": "FROM node\n"})
+	gitRun(t, "checkout", "-q", "feature")
+
+	// the merge-base with the target branch, not the default branch
+	setDiffEnv(t, "pull_request", "refs/pull/1/head", feature, "main")
+	got, err := diffBase(context.Background())
+	if err != nil || got != base {
+		t.Errorf("want merge-base %s, got %q (%v)", base, got, err)
+	}
+
+	// without target branch the default branch is used
+	setDiffEnv(t, "", "refs/pull/1/head", feature, "")
+	c.DefaultBranch = "master"
+	_, err = diffBase(context.Background())
+	if !errors.Is(err, errNoDiffBase) {
+		t.Errorf("want %s, got %v", errNoDiffBase, err)
+	}
+}
+
+func TestDiffBaseForcePush(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{DefaultBranch: "main"}
+	gitRepo(t, "main")
+	base := gitCommit(t, map[string]string{"php/Dockerfile": "FROM php\n"})
+	gitRun(t, "checkout", "-qb", "feature")
+	previous := gitCommit(t, map[string]string{"php/Dockerfile": "FROM php:8.2\n"})
+	gitCommit(t, map[string]string{"php/Dockerfile": "FROM php:8.3\n"})
+
+	tests := []struct {
+		before string
+		want   string
+	}{
+		{previous, previous},
+		// a force push removed the previous commit from the history
+		{"1111111111111111111111111111111111111111", base},
+		// first push of the branch
+		{"0000000000000000000000000000000000000000", base},
+		{"", base},
+	}
+	for _, test := range tests {
+		setDiffEnv(t, "push", "refs/heads/feature", test.before, "")
+		got, err := diffBase(context.Background())
+		if err != nil || got != test.want {
+			t.Errorf("%q: want %s, got %q (%v)", test.before, test.want, got, err)
+		}
+	}
+
+	// on the default branch the previous commit is used
+	gitRun(t, "checkout", "-q", "main")
+	gitCommit(t, map[string]string{"node/Dockerfile": "FROM node\n"})
+	setDiffEnv(t, "push", "refs/heads/main", "1111111111111111111111111111111111111111", "")
+	got, err := diffBase(context.Background())
+	if err != nil || got != "HEAD^" {
+		t.Errorf("want HEAD^, got %q (%v)", got, err)
+	}
+}
+
+func TestDiffNoDiffBase(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{
+		Registry:         "localhost:5000",
+		DefaultNamespace: "images",
+		BuildPoolSize:    1,
+		UploadPoolSize:   1,
+		TagName:          "latest",
+		Command:          "echo",
+		DiffOnly:         true,
+	}
+	gitRepo(t, "main")
+	gitCommit(t, map[string]string{
+		"php/Dockerfile":  "FROM php\n",
+		"node/Dockerfile": "FROM node\n",
+	})
+	setDiffEnv(t, "push", "refs/heads/main", "", "")
+
+	_, err := diff(context.Background())
+	if !errors.Is(err, errNoDiffBase) {
+		t.Fatalf("want %s, got %v", errNoDiffBase, err)
+	}
+
+	// all images are built without diff base
+	built := []string{}
+	b := NewBuilder(builder, uploader, func(ctx context.Context, b *DockerBuild) {
+		built = append(built, b.Name)
+	}, nil)
+	err = b.Run(context.Background(), ".")
+	if err != nil {
+		t.Fatalf("failed to run: %s", err)
+	}
+	sort.Strings(built)
+	if strings.Join(built, " ") != "node php" {
+		t.Errorf("want all images built, got %v", built)
+	}
+}
+
+func TestSaveSuccessfulCommit(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	gitRepo(t, "main")
+	head := gitCommit(t, map[string]string{"php/Dockerfile": "FROM php\n"})
+	c = config{DiffStateFile: filepath.Join(t.TempDir(), "state", "last-success")}
+
+	err := saveSuccessfulCommit(context.Background())
+	if err != nil {
+		t.Fatalf("unable to save commit: %s", err)
+	}
+	got, err := lastSuccessfulCommit(context.Background())
+	if err != nil || got != head {
+		t.Errorf("want %s, got %q (%v)", head, got, err)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +17,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// pushDigest matches the digest in the output of docker push, i.e.
+// `8.3: digest: sha256:... size: 1234`
+var pushDigest = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+
 type (
 	// DockerBuild stores the build infomration
 	DockerBuild struct {
@@ -34,7 +42,56 @@ type (
 		// Froms stores all Dockerfile `FROM` commands
 		Froms []string
 
+		// Attempts stores the number of attempts per stage
+		Attempts map[string]int
+
+		// Timeout limits each stage of the build, 0 disables the limit
+		Timeout time.Duration
+
+		// Priority orders the build queue, higher priorities start first
+		Priority int
+
+		// TagPolicy overwrites the global tag policy
+		TagPolicy *TagPolicy
+
+		// FloatingTags are additional tags without build id, i.e. `8.3`
+		// for the newest `8.3.x`
+		FloatingTags []string
+
+		// Labels and Annotations are the rendered templates from the
+		// matrix, SensitiveArgs are never added as labels
+		Labels        map[string]string
+		Annotations   map[string]string
+		SensitiveArgs []string
+
+		// BaseDigest is the digest of the base image, resolved before the
+		// build
+		BaseDigest string
+
+		// ImageID and Size are inspected after the build, Size is the
+		// uncompressed size in bytes
+		ImageID string
+		Size    int64
+		// Digests stores the manifest digest per pushed tag
+		Digests map[string]string
+		// Durations stores the duration per stage
+		Durations map[string]time.Duration
+		// Waits stores the time waited for a free slot per stage
+		Waits map[string]time.Duration
+
+		// Reason explains why the build was selected, i.e. the changed
+		// files
+		Reason string
+
 		Error error
+
+		// span traces the build from scheduling until it is finished
+		span *Span
+		// logStarted is set once the log file is created, echoed counts
+		// the bytes streamed to the console until it is truncated
+		logStarted bool
+		echoed     int
+		truncated  bool
 	}
 )
 
@@ -52,6 +109,30 @@ func (b *DockerBuild) copy() *DockerBuild {
 	for key, val := range b.Arguments {
 		arguments[key] = val
 	}
+	attempts := make(map[string]int, len(b.Attempts))
+	for key, val := range b.Attempts {
+		attempts[key] = val
+	}
+	digests := make(map[string]string, len(b.Digests))
+	for key, val := range b.Digests {
+		digests[key] = val
+	}
+	durations := make(map[string]time.Duration, len(b.Durations))
+	for key, val := range b.Durations {
+		durations[key] = val
+	}
+	waits := make(map[string]time.Duration, len(b.Waits))
+	for key, val := range b.Waits {
+		waits[key] = val
+	}
+	labels := make(map[string]string, len(b.Labels))
+	for key, val := range b.Labels {
+		labels[key] = val
+	}
+	annotations := make(map[string]string, len(b.Annotations))
+	for key, val := range b.Annotations {
+		annotations[key] = val
+	}
 	return &DockerBuild{
 		ID:              b.ID,
 		Namespace:       b.Namespace,
@@ -65,6 +146,21 @@ func (b *DockerBuild) copy() *DockerBuild {
 		Output:          append(b.Output[0:0], b.Output...),
 		AsLatest:        b.AsLatest,
 		Froms:           append(b.Froms[0:0], b.Froms...),
+		Attempts:        attempts,
+		Timeout:         b.Timeout,
+		Priority:        b.Priority,
+		TagPolicy:       b.TagPolicy,
+		FloatingTags:    append(b.FloatingTags[0:0], b.FloatingTags...),
+		Labels:          labels,
+		Annotations:     annotations,
+		SensitiveArgs:   b.SensitiveArgs,
+		BaseDigest:      b.BaseDigest,
+		ImageID:         b.ImageID,
+		Size:            b.Size,
+		Digests:         digests,
+		Durations:       durations,
+		Waits:           waits,
+		Reason:          b.Reason,
 		Error:           b.Error,
 	}
 }
@@ -88,22 +184,55 @@ func (b *DockerBuild) prettyName() string {
 	return fmt.Sprintf("%s:%s", b.Name, tag)
 }
 
+// flaky reports the stages that needed more than one attempt
+func (b *DockerBuild) flaky() (stages []string) {
+	for stage, attempts := range b.Attempts {
+		if attempts > 1 {
+			stages = append(stages, fmt.Sprintf("%s: %d attempts", stage, attempts))
+		}
+	}
+	sort.Strings(stages)
+	return stages
+}
+
+// tagPolicy returns the tag policy of the image
+func (b *DockerBuild) tagPolicy() TagPolicy {
+	if b.TagPolicy != nil {
+		return *b.TagPolicy
+	}
+	return c.TagPolicy
+}
+
 // gather tags
 func (b *DockerBuild) tags() (combined []string) {
-	images := append(b.AdditionalNames, fmt.Sprintf("%s/%s/%s", c.Registry, b.Namespace, b.Name))
+	return b.tagsFor(c.Registry, c.TagBuildID, currentEvent())
+}
+
+// tagsFor gathers the tags of the tag policy event for the registry server,
+// with additional tags for the build id if it is not empty
+func (b *DockerBuild) tagsFor(server, buildID, event string) (combined []string) {
+	images := append(b.AdditionalNames, fmt.Sprintf("%s/%s/%s", server, b.Namespace, b.Name))
 
-	tags := []string{b.Tag}
-	if c.TagBuildID != "" {
-		tags = append(
-			tags,
-			strings.TrimPrefix(fmt.Sprintf("%s-%s", b.Tag, c.TagBuildID), "-"),
-		)
+	policy := b.tagPolicy()
+	tags := []string{}
+	for _, tag := range policy.Apply(event, b.Tag) {
+		tags = append(tags, tag)
+		if buildID != "" {
+			tags = append(
+				tags,
+				strings.TrimPrefix(fmt.Sprintf("%s-%s", tag, buildID), "-"),
+			)
+		}
+	}
+	for _, floating := range b.FloatingTags {
+		tags = append(tags, policy.Apply(event, floating)...)
 	}
+	latest := policy.AllowsLatest(event)
 	for _, name := range images {
 		for _, tag := range tags {
 			tag = strings.TrimPrefix(tag, "latest-")
-			if tag == b.AsLatest {
-				combined = append(combined, fmt.Sprintf("%s/%s/%s:latest", c.Registry, b.Namespace, b.Name))
+			if latest && tag == b.AsLatest {
+				combined = append(combined, fmt.Sprintf("%s/%s/%s:latest", server, b.Namespace, b.Name))
 			}
 			combined = append(combined, fmt.Sprintf("%s:%s", name, tag))
 		}
@@ -132,32 +261,82 @@ func (b *DockerBuild) args() []string {
 		args = append(args, "--pull")
 	}
 
-	args = append(args,
-		"--label", fmt.Sprintf("org.label-schema.schema-version=%s", "1.0"),
-		"--label", fmt.Sprintf("org.label-schema.vcs-ref=%s", os.Getenv("DRONE_COMMIT_REF")),
-		"--label", fmt.Sprintf("org.label-schema.vcs-url=%s", os.Getenv("DRONE_REPO_LINK")),
-		"--label", fmt.Sprintf("org.label-schema.build-date=%s", c.Time.Format(time.RFC3339)),
-	)
+	for _, label := range b.labels() {
+		args = append(args, "--label", label)
+	}
+	for _, annotation := range b.annotations() {
+		args = append(args, "--annotation", annotation)
+	}
 
 	return args
 }
 
 // build builds the image
-func (b *DockerBuild) build() (err error) {
-	cmd := exec.Command(c.Command, b.args()...)
-	_ = cmd.Wait()
-	b.Output, err = cmd.CombinedOutput()
+func (b *DockerBuild) build(ctx context.Context) (err error) {
+	b.resolveBaseDigest(ctx)
+	cmd := command(ctx, b.args()...)
+	output := b.newOutput()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = cmd.Run()
+	b.Output = output.Close()
 	return err
 }
 
+// inspect stores the image id and the size of the built image
+func (b *DockerBuild) inspect(ctx context.Context) {
+	tags := b.tags()
+	if len(tags) == 0 {
+		return
+	}
+	cmd := command(ctx, "image", "inspect", "--format", "{{.Id}} {{.Size}}", tags[0])
+	out, err := cmd.Output()
+	if err != nil {
+		log.Debugf("%s unable to inspect %s: %s", b.ID, tags[0], err)
+		return
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "sha256:") {
+		return
+	}
+	b.ImageID = fields[0]
+	b.Size, _ = strconv.ParseInt(fields[1], 10, 64)
+}
+
+// setDigest records the pushed digest of the tag
+func (b *DockerBuild) setDigest(tag, digest string) {
+	if digest == "" {
+		return
+	}
+	if b.Digests == nil {
+		b.Digests = map[string]string{}
+	}
+	b.Digests[tag] = digest
+}
+
+// setDuration records the duration of a stage
+func (b *DockerBuild) setDuration(stage string, duration time.Duration) {
+	if b.Durations == nil {
+		b.Durations = map[string]time.Duration{}
+	}
+	b.Durations[stage] = duration
+}
+
+// setWait records the time waited for a free slot of a stage
+func (b *DockerBuild) setWait(stage string, wait time.Duration) {
+	if b.Waits == nil {
+		b.Waits = map[string]time.Duration{}
+	}
+	b.Waits[stage] = wait
+}
+
 // upload uploads the image
-func (b *DockerBuild) upload() (err error) {
+func (b *DockerBuild) upload(ctx context.Context) (err error) {
+	if c.RegistryAPI && registry != nil {
+		return b.uploadOnce(ctx)
+	}
 	for _, tag := range b.tags() {
-		log.Warnf("Uploading      %s", tag)
-		cmd := exec.Command(c.Command, "push", tag)
-		_ = cmd.Wait()
-		subOut, err := cmd.CombinedOutput()
-		b.Output = append(b.Output, subOut...)
+		err = b.push(ctx, tag)
 		if err != nil {
 			return err
 		}
@@ -165,6 +344,89 @@ func (b *DockerBuild) upload() (err error) {
 	return err
 }
 
+// uploadOnce pushes the image once per registry and creates all other tags
+// via the registry api, falls back to a push if that fails
+func (b *DockerBuild) uploadOnce(ctx context.Context) error {
+	pushed := map[string]Reference{}
+	pushedTags := map[string]string{}
+	for _, tag := range b.tags() {
+		ref, err := ParseReference(tag)
+		if err != nil {
+			return err
+		}
+		src, found := pushed[ref.Host]
+		if found {
+			log.Warnf("Tagging        %s", tag)
+			_, span := tracer.Start(ctx, "tag", "image.tag", tag)
+			err = registry.Copy(ctx, src, ref)
+			span.End(err)
+			if err == nil {
+				b.setDigest(tag, b.Digests[pushedTags[ref.Host]])
+				continue
+			}
+			log.Warnf("%s unable to tag %s via registry api, pushing instead: %s", b.ID, tag, err)
+		}
+		err = b.push(ctx, tag)
+		if err != nil {
+			return err
+		}
+		if !found {
+			pushed[ref.Host] = ref
+			pushedTags[ref.Host] = tag
+		}
+	}
+	return nil
+}
+
+// push pushes a single tag
+func (b *DockerBuild) push(ctx context.Context, tag string) (err error) {
+	ctx, span := tracer.Start(ctx, "push", "image.tag", tag)
+	defer func() { span.End(err) }()
+	start := time.Now()
+	events.EmitBuild(eventPushStarted, b, &Event{Target: tag})
+	defer func() {
+		events.EmitBuild(eventPushFinished, b, &Event{
+			Target:   tag,
+			Digest:   b.Digests[tag],
+			Error:    errorText(err),
+			Duration: time.Since(start).Seconds(),
+		})
+	}()
+
+	log.Warnf("Uploading      %s", tag)
+	var digest string
+	err = uploadRetry.Do(ctx, b, "upload", func() ([]byte, error) {
+		cmd := command(ctx, "push", tag)
+		output := b.newOutput()
+		cmd.Stdout = output
+		cmd.Stderr = output
+		err := cmd.Run()
+		subOut := output.Close()
+		b.Output = append(b.Output, subOut...)
+		if match := pushDigest.FindSubmatch(subOut); match != nil {
+			digest = string(match[1])
+		}
+		return subOut, err
+	})
+	if err != nil {
+		return err
+	}
+
+	// fall back to the registry if the output contains no digest
+	if digest == "" && registry != nil {
+		ref, err := ParseReference(tag)
+		if err == nil {
+			digest, err = registry.Digest(ctx, ref)
+		}
+		if err != nil {
+			log.Debugf("%s unable to resolve digest of %s: %s", b.ID, tag, err)
+		}
+	}
+	b.setDigest(tag, digest)
+	span.SetAttribute("image.digest", digest)
+	return nil
+}
+
 // parseFromsFromDockerfile searches for all FROM statements and builds a list
 // of all FROM images
 func parseFromsFromDockerfile(path string) ([]string, error) {
@@ -180,3 +442,50 @@ func parseFromsFromDockerfile(path string) ([]string, error) {
 	}
 	return froms, nil
 }
+
+// parseSourcesFromDockerfile returns the sources of all COPY and ADD
+// statements that copy from the build context. all is true if a source is
+// the whole context or cannot be determined.
+func parseSourcesFromDockerfile(path string) (sources []string, all bool, err error) {
+	dockerfile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, true, fmt.Errorf("unable to read dockerfile: %w", err)
+	}
+	content := regexp.MustCompile(`\\[ \t]*\r?\n`).ReplaceAllString(string(dockerfile), " ")
+	command := regexp.MustCompile(`(?im)^[ \t]*(COPY|ADD)[ \t]+(.*)$`)
+	for _, match := range command.FindAllStringSubmatch(content, -1) {
+		args := strings.TrimSpace(match[2])
+		fields := strings.Fields(args)
+		fromStage := false
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			if strings.HasPrefix(fields[0], "--from=") {
+				fromStage = true
+			}
+			fields = fields[1:]
+		}
+		if fromStage {
+			continue
+		}
+		rest := strings.Join(fields, " ")
+		if strings.HasPrefix(rest, "[") {
+			fields = []string{}
+			if json.Unmarshal([]byte(rest), &fields) != nil {
+				return nil, true, nil
+			}
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		for _, source := range fields[:len(fields)-1] {
+			if isRemoteContext(source) {
+				continue
+			}
+			source = filepath.Clean(source)
+			if source == "." || source == "/" || strings.Contains(source, "$") {
+				return nil, true, nil
+			}
+			sources = append(sources, strings.TrimPrefix(source, "/"))
+		}
+	}
+	return sources, false, nil
+}
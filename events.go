@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// event types, the stage events carry the stage `build` or `upload`
+const (
+	eventPlanned      = "planned"
+	eventQueued       = "queued"
+	eventStarted      = "started"
+	eventFinished     = "finished"
+	eventPushStarted  = "push_started"
+	eventPushFinished = "push_finished"
+	eventSucceeded    = "succeeded"
+	eventSkipped      = "skipped"
+	eventFailed       = "failed"
+	eventRunFinished  = "run_finished"
+)
+
+// eventBuffer is the number of events queued for a slow target, further
+// events are dropped
+const eventBuffer = 4096
+
+type (
+	// Event is a state transition of the run or of a build
+	Event struct {
+		Time      time.Time `json:"time"`
+		Type      string    `json:"type"`
+		ID        string    `json:"id,omitempty"`
+		Namespace string    `json:"namespace,omitempty"`
+		Name      string    `json:"name,omitempty"`
+		Tag       string    `json:"tag,omitempty"`
+		// Stage is the worker of queued, started and finished events
+		Stage string `json:"stage,omitempty"`
+		// Target is the pushed tag of push events
+		Target string `json:"target,omitempty"`
+		Digest string `json:"digest,omitempty"`
+		Status string `json:"status,omitempty"`
+		Reason string `json:"reason,omitempty"`
+		Error  string `json:"error,omitempty"`
+		// Duration of the finished stage, push or run in seconds
+		Duration float64 `json:"duration,omitempty"`
+		// Counts are the builds per status of run_finished
+		Counts map[string]int `json:"counts,omitempty"`
+	}
+
+	// EventStream writes events as json lines to a file, a unix socket or
+	// an http endpoint. Events are written in the background so a slow
+	// target never blocks the builds. A nil stream discards all events.
+	EventStream struct {
+		target  string
+		writer  io.WriteCloser
+		queue   chan *Event
+		done    chan bool
+		dropped int
+		// observers receive each event before it is queued
+		observers []func(*Event)
+
+		mu sync.Mutex
+	}
+
+	// httpEventWriter posts each batch of events as `application/x-ndjson`
+	httpEventWriter struct {
+		url string
+	}
+)
+
+// events receives the events of the run, set up in main if a target is
+// configured
+var events *EventStream
+
+// NewEventStream opens the target, `unix://` paths are unix sockets,
+// `http://` and `https://` urls receive batches via POST, anything else is
+// a file the events are appended to. Without target the events are only
+// passed to the observers.
+func NewEventStream(target string) (*EventStream, error) {
+	var writer io.WriteCloser
+	switch {
+	case target == "":
+		return &EventStream{}, nil
+	case strings.HasPrefix(target, "unix://"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(target, "unix://"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to event socket: %w", err)
+		}
+		writer = conn
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		writer = &httpEventWriter{url: target}
+	default:
+		path, err := filepath.Abs(strings.TrimPrefix(target, "file://"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve event file: %w", err)
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create event directory: %w", err)
+		}
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open event file: %w", err)
+		}
+		writer = file
+	}
+
+	s := &EventStream{
+		target: target,
+		writer: writer,
+		queue:  make(chan *Event, eventBuffer),
+		done:   make(chan bool),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Write posts the events
+func (w *httpEventWriter) Write(content []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return len(content), nil
+}
+
+// Close does nothing, each batch is a separate request
+func (w *httpEventWriter) Close() error {
+	return nil
+}
+
+// run writes the queued events, all events queued at once are written as
+// a single batch
+func (s *EventStream) run() {
+	defer close(s.done)
+	failed := false
+	for event := range s.queue {
+		batch := &bytes.Buffer{}
+		encoder := json.NewEncoder(batch)
+		_ = encoder.Encode(event)
+	drain:
+		for {
+			select {
+			case next, ok := <-s.queue:
+				if !ok {
+					break drain
+				}
+				_ = encoder.Encode(next)
+			default:
+				break drain
+			}
+		}
+		_, err := s.writer.Write(secrets.RedactBytes(batch.Bytes()))
+		if err != nil && !failed {
+			log.Warnf("Unable to write events to %s: %s", s.target, err)
+		}
+		failed = err != nil
+	}
+}
+
+// Subscribe passes all further events to observe, observers are called
+// synchronously and must not block
+func (s *EventStream) Subscribe(observe func(*Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, observe)
+}
+
+// Emit queues the event, the time is set if missing
+func (s *EventStream) Emit(event *Event) {
+	if s == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.mu.Lock()
+	observers := s.observers
+	s.mu.Unlock()
+	for _, observe := range observers {
+		observe(event)
+	}
+	if s.queue == nil {
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+}
+
+// EmitBuild queues an event of the build
+func (s *EventStream) EmitBuild(eventType string, b *DockerBuild, event *Event) {
+	if s == nil {
+		return
+	}
+	if event == nil {
+		event = &Event{}
+	}
+	event.Type = eventType
+	event.ID = b.ID.String()
+	event.Namespace = b.Namespace
+	event.Name = b.Name
+	event.Tag = b.Tag
+	s.Emit(event)
+}
+
+// Close writes the remaining events and closes the target
+func (s *EventStream) Close() error {
+	if s == nil || s.queue == nil {
+		return nil
+	}
+	close(s.queue)
+	<-s.done
+	s.mu.Lock()
+	dropped := s.dropped
+	s.mu.Unlock()
+	if dropped > 0 {
+		log.Warnf("Dropped %d events, %s is too slow", dropped, s.target)
+	}
+	return s.writer.Close()
+}
+
+// errorText returns the redacted error, empty for nil
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return secrets.Redact(err.Error())
+}
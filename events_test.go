@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// emitTestEvents emits the events of a failed build
+func emitTestEvents(s *EventStream) {
+	b := &DockerBuild{ID: ksuid.New(), Namespace: "images", Name: "php", Tag: "8.3"}
+	s.EmitBuild(eventPlanned, b, nil)
+	s.EmitBuild(eventStarted, b, &Event{Stage: "build"})
+	s.EmitBuild(eventFailed, b, &Event{Status: statusFailed, Error: "unable to login with event-secret-value"})
+}
+
+// decodeEvents decodes json lines of events
+func decodeEvents(t *testing.T, content []byte) []*Event {
+	decoded := []*Event{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		event := &Event{}
+		err := json.Unmarshal(scanner.Bytes(), event)
+		if err != nil {
+			t.Fatalf("invalid event %s: %s", scanner.Text(), err)
+		}
+		decoded = append(decoded, event)
+	}
+	return decoded
+}
+
+// checkEvents compares the decoded events with the events of emitTestEvents
+func checkEvents(t *testing.T, target string, decoded []*Event) {
+	if len(decoded) != 3 {
+		t.Fatalf("%s: want 3 events, got %d", target, len(decoded))
+	}
+	for i, eventType := range []string{eventPlanned, eventStarted, eventFailed} {
+		event := decoded[i]
+		if event.Type != eventType || event.Name != "php" || event.Tag != "8.3" || event.ID == "" || event.Time.IsZero() {
+			t.Errorf("%s: unexpected event %+v", target, event)
+		}
+	}
+	if decoded[1].Stage != "build" || decoded[2].Error != "unable to login with ********" {
+		t.Errorf("%s: unexpected events %+v %+v", target, decoded[1], decoded[2])
+	}
+}
+
+func TestEventStreamTargets(t *testing.T) {
+	secrets.Add("event-secret-value")
+	dir := t.TempDir()
+
+	// events are appended to files
+	file := filepath.Join(dir, "events", "events.jsonl")
+	s, err := NewEventStream("file://" + file)
+	if err != nil {
+		t.Fatalf("unable to open file: %s", err)
+	}
+	emitTestEvents(s)
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("unable to close file: %s", err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEvents(t, "file", decodeEvents(t, content))
+
+	// http endpoints receive batches of json lines
+	mutex := sync.Mutex{}
+	received := &bytes.Buffer{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected request %s %v", r.Method, r.Header)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		_, _ = io.Copy(received, r.Body)
+	}))
+	defer server.Close()
+	s, err = NewEventStream(server.URL)
+	if err != nil {
+		t.Fatalf("unable to set up http events: %s", err)
+	}
+	emitTestEvents(s)
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("unable to close http events: %s", err)
+	}
+	checkEvents(t, "http", decodeEvents(t, received.Bytes()))
+
+	// unix sockets receive a stream of json lines
+	socket := filepath.Join(dir, "events.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	streamed := make(chan []byte)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			streamed <- nil
+			return
+		}
+		content, _ := io.ReadAll(conn)
+		streamed <- content
+	}()
+	s, err = NewEventStream("unix://" + socket)
+	if err != nil {
+		t.Fatalf("unable to connect to socket: %s", err)
+	}
+	emitTestEvents(s)
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("unable to close socket: %s", err)
+	}
+	checkEvents(t, "unix", decodeEvents(t, <-streamed))
+}
+
+func TestEventStreamObservers(t *testing.T) {
+	s, err := NewEventStream("")
+	if err != nil {
+		t.Fatalf("unable to create stream without target: %s", err)
+	}
+	observed := []*Event{}
+	s.Subscribe(func(event *Event) {
+		observed = append(observed, event)
+	})
+	emitTestEvents(s)
+	if err := s.Close(); err != nil {
+		t.Errorf("unexpected error closing a stream without target: %s", err)
+	}
+	if len(observed) != 3 || observed[0].Type != eventPlanned || observed[2].Type != eventFailed || observed[1].Time.IsZero() {
+		t.Errorf("unexpected observed events %v", observed)
+	}
+
+	// a nil stream discards the events
+	var disabled *EventStream
+	emitTestEvents(disabled)
+	if err := disabled.Close(); err != nil {
+		t.Errorf("unexpected error closing a nil stream: %s", err)
+	}
+}
+
+// blockingWriter blocks all writes until release is closed
+type blockingWriter struct {
+	release chan bool
+}
+
+func (w *blockingWriter) Write(content []byte) (int, error) {
+	<-w.release
+	return 0, errors.New("target unavailable")
+}
+
+func (w *blockingWriter) Close() error {
+	return nil
+}
+
+func TestEventStreamDropped(t *testing.T) {
+	output := &bytes.Buffer{}
+	oldOutput := log.StandardLogger().Out
+	log.SetOutput(output)
+	defer log.SetOutput(oldOutput)
+
+	writer := &blockingWriter{release: make(chan bool)}
+	s := &EventStream{
+		target: "slow",
+		writer: writer,
+		queue:  make(chan *Event, eventBuffer),
+		done:   make(chan bool),
+	}
+	go s.run()
+
+	// the events beyond the buffer of a blocked target are dropped
+	for i := 0; i < eventBuffer+10; i++ {
+		s.Emit(&Event{Type: eventQueued})
+	}
+	close(writer.release)
+	err := s.Close()
+	if err != nil {
+		t.Fatalf("unable to close: %s", err)
+	}
+	if s.dropped < 9 || s.dropped > 10 {
+		t.Errorf("want 9 or 10 dropped events, got %d", s.dropped)
+	}
+	logged := output.String()
+	if strings.Count(logged, "Dropped ") != 1 || strings.Count(logged, "Unable to write events") != 1 {
+		t.Errorf("want a single warning per failure, got\n%s", logged)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"strings"
 	"sync"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type (
@@ -9,15 +13,86 @@ type (
 		wg      *sync.WaitGroup
 		input   <-chan *DockerBuild
 		handler BuildHandler
+
+		// results stores all finished builds for the summary
+		results []*DockerBuild
+		// unselected stores the builds skipped by the diff
+		unselected []*DockerBuild
+		// deps is notified about finished builds
+		deps *Dependencies
 	}
 )
 
-func (f *Finisher) Handle() {
+func (f *Finisher) Handle(ctx context.Context) {
 	defer f.wg.Done()
 	for b := range f.input {
-		f.handler(b)
+		finishCtx, span := tracer.Start(contextWithSpan(ctx, b.span), "finish")
+		f.handler(finishCtx, b)
+		span.End(nil)
+		b.span.SetAttribute("image.status", b.status())
+		b.span.End(b.Error)
+		f.emit(b)
+		f.results = append(f.results, b)
+		f.deps.Done(b)
+	}
+}
+
+// emit reports the final status of the build
+func (f *Finisher) emit(b *DockerBuild) {
+	status := b.status()
+	eventType := eventSkipped
+	switch status {
+	case statusSucceeded:
+		eventType = eventSucceeded
+	case statusFailed:
+		eventType = eventFailed
 	}
+	events.EmitBuild(eventType, b, &Event{
+		Status:   status,
+		Reason:   b.Reason,
+		Error:    errorText(b.Error),
+		Duration: b.duration().Seconds(),
+	})
 }
+
 func (f *Finisher) Wait() {
 	f.wg.Wait()
 }
+
+// Succeeded checks if all builds were successful
+func (f *Finisher) Succeeded() bool {
+	for _, b := range f.results {
+		if b.Error != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Summary logs the number of successful, failed, skipped and canceled builds
+// and lists the builds that were not successful
+func (f *Finisher) Summary() {
+	var succeeded, failed, skipped, canceled []string
+	for _, b := range f.results {
+		switch b.status() {
+		case statusSucceeded:
+			succeeded = append(succeeded, b.prettyName())
+		case statusSkipped:
+			skipped = append(skipped, b.prettyName()+": "+b.Error.Error())
+		case statusCanceled:
+			canceled = append(canceled, b.prettyName()+": "+b.Error.Error())
+		default:
+			failed = append(failed, b.prettyName()+": "+b.Error.Error())
+		}
+	}
+	log.Infof("Summary        %d succeeded, %d failed, %d skipped, %d canceled", len(succeeded), len(failed), len(skipped), len(canceled))
+	if len(failed) > 0 {
+		log.Errorf("Failed builds\n%s", indent(strings.Join(failed, "\n"), "  "))
+	}
+	if len(skipped) > 0 {
+		log.Warnf("Skipped builds\n%s", indent(strings.Join(skipped, "\n"), "  "))
+	}
+	if len(canceled) > 0 {
+		log.Warnf("Canceled builds\n%s", indent(strings.Join(canceled, "\n"), "  "))
+	}
+}
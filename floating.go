@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var semverPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?$`)
+
+type (
+	// FloatingTags configures alias tags for a semver dimension of the
+	// matrix:
+	//
+	//   floating_tags:
+	//     dimension: VERSION
+	//     unversioned: true
+	//
+	// will tag `8.3.12-alpine` as `8.3-alpine`, `8-alpine` and `alpine` if
+	// it is the newest version of its siblings
+	FloatingTags struct {
+		// Dimension is the argument that contains the version
+		Dimension string `yaml:"dimension"`
+		// Unversioned additionally tags the newest version without the
+		// version
+		Unversioned bool `yaml:"unversioned"`
+	}
+
+	// semver is a parsed version, missing parts are -1
+	semver [3]int
+)
+
+// parseSemver parses `1`, `1.2` and `1.2.3` with an optional `v` prefix,
+// pre-releases are not supported
+func parseSemver(version string) (semver, bool) {
+	match := semverPattern.FindStringSubmatch(version)
+	if match == nil {
+		return semver{}, false
+	}
+	v := semver{-1, -1, -1}
+	for i, part := range match[1:] {
+		if part != "" {
+			v[i], _ = strconv.Atoi(part)
+		}
+	}
+	return v, true
+}
+
+// less compares two versions
+func (v semver) less(other semver) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+// aliases returns the floating versions, i.e. `8.3` and `8` for `8.3.12`
+func (v semver) aliases() (aliases []string) {
+	if v[2] >= 0 {
+		aliases = append(aliases, fmt.Sprintf("%d.%d", v[0], v[1]))
+	}
+	if v[1] >= 0 {
+		aliases = append(aliases, fmt.Sprintf("%d", v[0]))
+	}
+	return aliases
+}
+
+// tagWithArgument builds the tag of b like copyWithArgument does, with the
+// value of name replaced
+func tagWithArgument(b *DockerBuild, name, value string) string {
+	parts := []string{}
+	for _, arg := range b.ArgumentOrder {
+		argValue := b.Arguments[arg]
+		if arg == name {
+			argValue = value
+		}
+		if argValue != "" {
+			parts = append(parts, argValue)
+		}
+	}
+	if len(parts) == 0 {
+		return "latest"
+	}
+	return strings.Join(parts, "-")
+}
+
+// applyFloatingTags sets the floating tags of all builds. Builds with the
+// same arguments besides the dimension are siblings, each alias is assigned
+// to the newest sibling that matches it.
+func applyFloatingTags(builds []*DockerBuild, config *FloatingTags) {
+	if config == nil || config.Dimension == "" {
+		return
+	}
+
+	type candidate struct {
+		build   *DockerBuild
+		version semver
+	}
+	newest := map[string]candidate{}
+	existing := map[string]bool{}
+	for _, b := range builds {
+		existing[b.Tag] = true
+	}
+	for _, b := range builds {
+		value, found := b.Arguments[config.Dimension]
+		if !found || tagWithArgument(b, config.Dimension, value) != b.Tag {
+			continue
+		}
+		version, ok := parseSemver(value)
+		if !ok {
+			log.Warnf("%s floating tags: %s=%q of %s is not a version", b.ID, config.Dimension, value, b.prettyName())
+			continue
+		}
+		aliases := version.aliases()
+		if config.Unversioned {
+			aliases = append(aliases, "")
+		}
+		for _, alias := range aliases {
+			tag := tagWithArgument(b, config.Dimension, alias)
+			current, found := newest[tag]
+			if !found || current.version.less(version) {
+				newest[tag] = candidate{build: b, version: version}
+			}
+		}
+	}
+
+	tags := make([]string, 0, len(newest))
+	for tag := range newest {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		b := newest[tag].build
+		if existing[tag] {
+			continue
+		}
+		b.FloatingTags = append(b.FloatingTags, tag)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version string
+		want    semver
+		ok      bool
+	}{
+		{"8", semver{8, -1, -1}, true},
+		{"8.3", semver{8, 3, -1}, true},
+		{"8.3.12", semver{8, 3, 12}, true},
+		{"v1.22.0", semver{1, 22, 0}, true},
+		{"8.3.0-rc1", semver{}, false},
+		{"8.3.0rc1", semver{}, false},
+		{"1.2.3.4", semver{}, false},
+		{"latest", semver{}, false},
+		{"", semver{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseSemver(test.version)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%q: want %v %t, got %v %t", test.version, test.want, test.ok, got, ok)
+		}
+	}
+
+	if !(semver{8, 3, -1}).less(semver{8, 3, 0}) || !(semver{8, 3, 12}).less(semver{8, 10, 0}) || (semver{8, 3, 1}).less(semver{8, 3, 1}) {
+		t.Errorf("unexpected version order")
+	}
+}
+
+func TestSemverAliases(t *testing.T) {
+	tests := map[string][]string{
+		"8.3.12": {"8.3", "8"},
+		"8.3":    {"8"},
+		"8":      nil,
+	}
+	for version, want := range tests {
+		v, _ := parseSemver(version)
+		if got := v.aliases(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %v, got %v", version, want, got)
+		}
+	}
+}
+
+// floatingBuild creates a build with the tag of its version and os
+func floatingBuild(version, os string) *DockerBuild {
+	b := &DockerBuild{
+		Name:          "php",
+		Arguments:     map[string]string{"VERSION": version, "OS": os},
+		ArgumentOrder: []string{"VERSION", "OS"},
+	}
+	b.Tag = tagWithArgument(b, "VERSION", version)
+	return b
+}
+
+func TestApplyFloatingTags(t *testing.T) {
+	builds := map[string]*DockerBuild{}
+	list := []*DockerBuild{}
+	for _, tag := range [][2]string{
+		{"8.2.20", "alpine"},
+		{"8.3.9", "alpine"},
+		{"8.3.12", "alpine"},
+		{"8.4.0-rc1", "alpine"},
+		{"7.4.33", "alpine"},
+		{"8.3.12", "debian"},
+		{"8.1", "debian"},
+		{"8", "debian"},
+	} {
+		b := floatingBuild(tag[0], tag[1])
+		builds[b.Tag] = b
+		list = append(list, b)
+	}
+
+	applyFloatingTags(list, &FloatingTags{Dimension: "VERSION", Unversioned: true})
+	want := map[string][]string{
+		"8.2.20-alpine": {"8.2-alpine"},
+		"8.3.12-alpine": {"8-alpine", "8.3-alpine", "alpine"},
+		"7.4.33-alpine": {"7-alpine", "7.4-alpine"},
+		// 8-debian exists, it is not an alias of 8.3.12-debian
+		"8.3.12-debian": {"8.3-debian", "debian"},
+	}
+	for tag, b := range builds {
+		if !reflect.DeepEqual(b.FloatingTags, want[tag]) {
+			t.Errorf("%s: want %v, got %v", tag, want[tag], b.FloatingTags)
+		}
+	}
+
+	// without a dimension nothing is tagged
+	b := floatingBuild("8.3.12", "alpine")
+	applyFloatingTags([]*DockerBuild{b}, &FloatingTags{})
+	applyFloatingTags([]*DockerBuild{b}, nil)
+	if len(b.FloatingTags) != 0 {
+		t.Errorf("unexpected floating tags %v", b.FloatingTags)
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -18,28 +23,78 @@ func indent(text string, prefix string) (out string) {
 	return out
 }
 
-// git diff
-func diff() (dirs map[string]bool, err error) {
-	before := os.Getenv("DRONE_COMMIT_BEFORE")
-	ref := os.Getenv("DRONE_COMMIT_REF")
-	dirs = map[string]bool{}
+// writeFileAtomic replaces the file at path via a temporary file and a
+// rename, readers never see a partial file
+func writeFileAtomic(path string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// commandWaitDelay is the time a canceled command has to exit after the
+// interrupt before it is killed
+var commandWaitDelay = 10 * time.Second
+
+// command creates a command for c.Command that is interrupted when ctx is
+// canceled and killed if it does not exit within commandWaitDelay
+func command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.Command, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+// runContext is canceled on SIGINT and SIGTERM and after timeout, a timeout
+// of 0 disables the limit
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := withTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// withTimeout limits ctx to timeout, a timeout of 0 only adds a cancel
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-	if strings.HasPrefix(ref, "refs/pull/") {
-		// pull request
-		before = "origin/master"
-	} else if before != "" {
-		// normal commit, usually ref is a sha
-		before = strings.TrimPrefix(before, "refs/")
-	} else {
-		// empty history, skipping build
-		// TODO: remove this
-		return nil, nil
-		//return nil, fmt.Errorf("unable to fetch previos commit from DRONE_COMMIT_REF")
+// git diff, returns the changed image directories with the files that
+// triggered them
+func diff(ctx context.Context) (dirs map[string][]string, err error) {
+	before, err := diffBase(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	// changes since last commit
-	cmd := exec.Command("git", "diff", "--name-only", before)
-	_ = cmd.Wait()
+	cmd := exec.CommandContext(ctx, "git", "diff", "--name-only", before)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, err
@@ -49,8 +104,7 @@ func diff() (dirs map[string]bool, err error) {
 	_, inDrone := os.LookupEnv("DRONE")
 	if !inDrone && len(out) == 0 {
 		log.Warn("No changes found, looking for uncommited changes.")
-		cmd = exec.Command("git", "status", "-u", "--porcelain")
-		_ = cmd.Wait()
+		cmd = exec.CommandContext(ctx, "git", "status", "-u", "--porcelain")
 		out2, err := cmd.CombinedOutput()
 		if err != nil {
 			return nil, err
@@ -64,16 +118,22 @@ func diff() (dirs map[string]bool, err error) {
 		}
 	}
 
+	files := []string{}
 	for _, file := range strings.Split(string(out), "\n") {
-		split := strings.Split(file, string(os.PathSeparator))
-		if len(split) > 0 {
-			name := split[0]
-			if _, err := os.Stat(filepath.Join(name, "Dockerfile")); err == nil {
-				dirs[name] = true
-			}
+		if file != "" {
+			files = append(files, file)
 		}
 	}
+	dirs, err = changedImages(files)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Infof("Diff mode enabled (%s), building following images: %v", before, dirs)
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Infof("Diff mode enabled (%s), building following images: %v", before, names)
 	return dirs, nil
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the files with their content below dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// chdir changes the working directory until the test is done
+func chdir(t *testing.T, dir string) {
+	oldPath, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(oldPath) })
+}
+
+// runSignaled runs the command and returns the signal that stopped it
+func runSignaled(t *testing.T, cmd *exec.Cmd) (syscall.Signal, time.Duration) {
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatalf("expected the command to be stopped")
+	}
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		t.Fatalf("command not stopped by a signal: %s", err)
+	}
+	return status.Signal(), elapsed
+}
+
+func TestCommandTimeout(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c.Command = "sh"
+
+	// the command is interrupted once the timeout expires
+	ctx, cancel := withTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	signal, elapsed := runSignaled(t, command(ctx, "-c", "exec sleep 10"))
+	if signal != syscall.SIGINT || elapsed > 5*time.Second {
+		t.Errorf("want an interrupt after the timeout, got %s after %s", signal, elapsed)
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("unexpected context error %v", ctx.Err())
+	}
+
+	// a timeout of 0 does not limit the context
+	ctx, cancel = withTimeout(context.Background(), 0)
+	if _, found := ctx.Deadline(); found {
+		t.Errorf("unexpected deadline without timeout")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Errorf("context not canceled")
+	}
+}
+
+func TestCommandWaitDelay(t *testing.T) {
+	oldConfig, oldDelay := c, commandWaitDelay
+	defer func() { c, commandWaitDelay = oldConfig, oldDelay }()
+	c.Command = "sh"
+	commandWaitDelay = 200 * time.Millisecond
+
+	// commands ignoring the interrupt are killed after the wait delay
+	ctx, cancel := withTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	signal, elapsed := runSignaled(t, command(ctx, "-c", "trap '' INT; sleep 10; true"))
+	if signal != syscall.SIGKILL {
+		t.Errorf("want the command to be killed, got %s", signal)
+	}
+	if elapsed < 300*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("want a kill after the wait delay, got %s", elapsed)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := runContext(0)
+	defer cancel()
+
+	// SIGTERM of the runner cancels the run
+	err := syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled by SIGTERM")
+	}
+
+	ctx, cancel = runContext(50 * time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("unexpected context error %v", ctx.Err())
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modeHistory prints the history of an image
+const modeHistory = "history"
+
+type (
+	// HistoryRecord is the outcome of a build in a previous run
+	HistoryRecord struct {
+		Name string    `json:"name"`
+		Tag  string    `json:"tag"`
+		Time time.Time `json:"time"`
+		// Status is succeeded, failed, skipped or canceled
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+		// Duration is the total of all stages in seconds, Durations per
+		// stage
+		Duration  float64            `json:"duration"`
+		Durations map[string]float64 `json:"durations,omitempty"`
+		Attempts  map[string]int     `json:"attempts,omitempty"`
+		// InputHash changes with the build context and the arguments
+		InputHash   string `json:"input_hash,omitempty"`
+		Digest      string `json:"digest,omitempty"`
+		Commit      string `json:"commit,omitempty"`
+		BuildNumber string `json:"build_number,omitempty"`
+	}
+
+	// HistoryStore stores the records of all runs
+	HistoryStore interface {
+		// Record stores the records of a run
+		Record(ctx context.Context, records []*HistoryRecord) error
+		// Query returns the newest records of an image, of all tags if
+		// tag is empty. A limit of 0 returns all records.
+		Query(ctx context.Context, name, tag string, limit int) ([]*HistoryRecord, error)
+	}
+
+	// fileHistory stores the records as json file, i.e. on a drone cache
+	// volume. Only the newest records per tag are kept.
+	fileHistory struct {
+		path string
+		keep int
+		mu   sync.Mutex
+	}
+
+	// historyFile is the content of the json file, the records of each
+	// image and tag are stored newest first
+	historyFile struct {
+		Images map[string]map[string][]*HistoryRecord `json:"images"`
+	}
+
+	// httpHistory stores the records in a history service. Records are
+	// sent to `POST <url>/records` as json list, queried via
+	// `GET <url>/records?name=<name>&tag=<tag>&limit=<limit>`.
+	httpHistory struct {
+		url    string
+		token  string
+		client *http.Client
+	}
+)
+
+// history stores the results of each run, set up in main if configured
+var history HistoryStore
+
+// NewHistoryStore creates the store for target, http urls use the history
+// service, anything else is a json file
+func NewHistoryStore(target, token string, keep int) HistoryStore {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &httpHistory{
+			url:    strings.TrimSuffix(target, "/"),
+			token:  token,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+	return &fileHistory{path: target, keep: keep}
+}
+
+// matchesTag compares the tag of a record, `latest-` prefixes are optional
+func (r *HistoryRecord) matchesTag(tag string) bool {
+	return tag == "" || r.Tag == tag || strings.TrimPrefix(r.Tag, "latest-") == tag
+}
+
+// load reads the history file, a missing file is an empty history
+func (h *fileHistory) load() (*historyFile, error) {
+	file := &historyFile{Images: map[string]map[string][]*HistoryRecord{}}
+	content, err := os.ReadFile(h.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return file, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read history: %w", err)
+	}
+	err = json.Unmarshal(content, file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse history %s: %w", h.path, err)
+	}
+	if file.Images == nil {
+		file.Images = map[string]map[string][]*HistoryRecord{}
+	}
+	return file, nil
+}
+
+// Record adds the records and drops all but the newest keep records per tag
+func (h *fileHistory) Record(ctx context.Context, records []*HistoryRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	file, err := h.load()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		tags, found := file.Images[record.Name]
+		if !found {
+			tags = map[string][]*HistoryRecord{}
+			file.Images[record.Name] = tags
+		}
+		tags[record.Tag] = append([]*HistoryRecord{record}, tags[record.Tag]...)
+		sort.SliceStable(tags[record.Tag], func(i, j int) bool {
+			return tags[record.Tag][i].Time.After(tags[record.Tag][j].Time)
+		})
+		if h.keep > 0 && len(tags[record.Tag]) > h.keep {
+			tags[record.Tag] = tags[record.Tag][:h.keep]
+		}
+	}
+	content, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("unable to encode history: %w", err)
+	}
+	err = writeFileAtomic(h.path, content)
+	if err != nil {
+		return fmt.Errorf("unable to write history: %w", err)
+	}
+	return nil
+}
+
+// Query returns the newest records of the image
+func (h *fileHistory) Query(ctx context.Context, name, tag string, limit int) ([]*HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	file, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	records := []*HistoryRecord{}
+	for _, tagRecords := range file.Images[name] {
+		for _, record := range tagRecords {
+			if record.matchesTag(tag) {
+				records = append(records, record)
+			}
+		}
+	}
+	return newestRecords(records, limit), nil
+}
+
+// newestRecords sorts the records newest first and applies the limit
+func newestRecords(records []*HistoryRecord, limit int) []*HistoryRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		if !records[i].Time.Equal(records[j].Time) {
+			return records[i].Time.After(records[j].Time)
+		}
+		return records[i].Tag < records[j].Tag
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+// do sends a request to the history service and decodes the response into
+// result if it is not nil
+func (h *httpHistory) do(ctx context.Context, method, target string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Record sends the records to the history service
+func (h *httpHistory) Record(ctx context.Context, records []*HistoryRecord) error {
+	content, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("unable to encode history: %w", err)
+	}
+	err = h.do(ctx, http.MethodPost, h.url+"/records", bytes.NewReader(content), nil)
+	if err != nil {
+		return fmt.Errorf("unable to record history: %w", err)
+	}
+	return nil
+}
+
+// Query requests the newest records of the image from the history service
+func (h *httpHistory) Query(ctx context.Context, name, tag string, limit int) ([]*HistoryRecord, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	records := []*HistoryRecord{}
+	err := h.do(ctx, http.MethodGet, h.url+"/records?"+query.Encode(), nil, &records)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query history: %w", err)
+	}
+	return newestRecords(records, limit), nil
+}
+
+// contextHashes caches the hash of each local build context and dockerfile,
+// the builds of a matrix share them
+var contextHashes sync.Map
+
+// inputHash hashes the build context, the dockerfile and the arguments.
+// Builds from remote contexts only hash the path and the arguments.
+func (b *DockerBuild) inputHash() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "path %s\ndockerfile %s\n", b.Path, b.Dockerfile)
+	for _, arg := range sortedKeys(b.Arguments) {
+		fmt.Fprintf(hash, "arg %s=%s\n", arg, b.Arguments[arg])
+	}
+	if info, err := os.Stat(b.Path); err == nil && info.IsDir() {
+		fmt.Fprintf(hash, "context %s\n", contextHash(b.Path, b.Dockerfile))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// contextHash hashes the dockerfile and the files of the build context that
+// are sent to docker, files excluded by the .dockerignore are skipped. Each
+// context is only hashed once.
+func contextHash(path, dockerfile string) string {
+	key := path + "\x00" + dockerfile
+	if sum, found := contextHashes.Load(key); found {
+		return sum.(string)
+	}
+
+	ignore, err := loadIgnore(path, dockerfile)
+	if err != nil {
+		log.Warnf("Unable to load the .dockerignore of %s, hashing all files: %s", path, err)
+		ignore = &PathPatterns{}
+	}
+	files := []string{}
+	_ = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, file)
+		if err == nil && rel != ".dockerignore" && ignore.Match(rel) {
+			return nil
+		}
+		files = append(files, file)
+		return nil
+	})
+	if dockerfile != "" {
+		files = append(files, dockerfile)
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		fmt.Fprintf(hash, "file %s %x\n", filepath.ToSlash(file), sum)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	contextHashes.Store(key, sum)
+	return sum
+}
+
+// historyRecord converts the build to a history record
+func (b *DockerBuild) historyRecord() *HistoryRecord {
+	record := &HistoryRecord{
+		Name:        b.Name,
+		Tag:         b.Tag,
+		Time:        c.Time,
+		Status:      b.status(),
+		Error:       errorText(b.Error),
+		Duration:    b.duration().Seconds(),
+		Durations:   map[string]float64{},
+		Attempts:    b.Attempts,
+		InputHash:   b.inputHash(),
+		Commit:      commitSHA(),
+		BuildNumber: os.Getenv("DRONE_BUILD_NUMBER"),
+	}
+	for stage, duration := range b.Durations {
+		record.Durations[stage] = duration.Seconds()
+	}
+	for _, tag := range b.tags() {
+		if digest := b.Digests[tag]; digest != "" {
+			record.Digest = digest
+			break
+		}
+	}
+	return record
+}
+
+// RecordHistory stores the results of the run in the history
+func (f *Finisher) RecordHistory(ctx context.Context, store HistoryStore) error {
+	records := make([]*HistoryRecord, 0, len(f.results))
+	for _, b := range f.results {
+		records = append(records, b.historyRecord())
+	}
+	return store.Record(ctx, records)
+}
+
+// historyDurations returns the duration of the last successful build per
+// `name:tag` of the images of the builds
+func historyDurations(ctx context.Context, store HistoryStore, builds []*DockerBuild) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+	queried := map[string]bool{}
+	for _, b := range builds {
+		if queried[b.Name] {
+			continue
+		}
+		queried[b.Name] = true
+		records, err := store.Query(ctx, b.Name, "", 0)
+		if err != nil {
+			return durations, err
+		}
+		for _, record := range records {
+			name := fmt.Sprintf("%s:%s", record.Name, strings.TrimPrefix(record.Tag, "latest-"))
+			if _, found := durations[name]; found || record.Status != statusSucceeded {
+				continue
+			}
+			durations[name] = time.Duration(record.Duration * float64(time.Second))
+		}
+	}
+	return durations, nil
+}
+
+// PrintHistory prints the newest records of an image, query is `name` or
+// `name:tag`
+func PrintHistory(ctx context.Context, store HistoryStore, query string, limit int, out io.Writer) error {
+	name, tag, _ := strings.Cut(query, ":")
+	if name == "" {
+		return fmt.Errorf("no image to query, expected name or name:tag")
+	}
+	records, err := store.Query(ctx, name, tag, limit)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tIMAGE\tSTATUS\tDURATION\tATTEMPTS\tCOMMIT\tDIGEST\tINPUT")
+	for _, record := range records {
+		attempts := 0
+		for _, count := range record.Attempts {
+			attempts += count
+		}
+		fmt.Fprintf(
+			w, "%s\t%s:%s\t%s\t%s\t%d\t%.12s\t%.19s\t%.12s\n",
+			record.Time.Format(time.RFC3339), record.Name, record.Tag, record.Status,
+			time.Duration(record.Duration*float64(time.Second)).Round(time.Second),
+			attempts, record.Commit, record.Digest, record.InputHash,
+		)
+	}
+	return w.Flush()
+}
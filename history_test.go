@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyRuns records three runs of php with a failure in the second run
+func historyRuns(t *testing.T, store HistoryStore) time.Time {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for run := 0; run < 3; run++ {
+		status := statusSucceeded
+		if run == 1 {
+			status = statusFailed
+		}
+		at := start.Add(time.Duration(run) * time.Hour)
+		err := store.Record(context.Background(), []*HistoryRecord{
+			{Name: "php", Tag: "8.3-alpine", Time: at, Status: status, Duration: float64(60 + run)},
+			{Name: "php", Tag: "latest-8.2", Time: at, Status: statusSucceeded, Duration: 30},
+			{Name: "python", Tag: "3.12", Time: at, Status: statusSucceeded, Duration: 10},
+		})
+		if err != nil {
+			t.Fatalf("unable to record run %d: %s", run, err)
+		}
+	}
+	return start
+}
+
+// recordTimes returns the tag and hour of each record
+func recordTimes(records []*HistoryRecord, start time.Time) []string {
+	times := []string{}
+	for _, record := range records {
+		times = append(times, record.Tag+"@"+strconv.Itoa(int(record.Time.Sub(start).Hours())))
+	}
+	return times
+}
+
+// testHistoryQueries checks the queries of the runs of historyRuns in a
+// store that keeps two records per tag
+func testHistoryQueries(t *testing.T, store HistoryStore, start time.Time) {
+	ctx := context.Background()
+	tests := []struct {
+		name, tag string
+		limit     int
+		want      []string
+	}{
+		{"php", "8.3-alpine", 10, []string{"8.3-alpine@2", "8.3-alpine@1"}},
+		{"php", "8.3-alpine", 1, []string{"8.3-alpine@2"}},
+		{"php", "8.2", 0, []string{"latest-8.2@2", "latest-8.2@1"}},
+		{"php", "", 3, []string{"8.3-alpine@2", "latest-8.2@2", "8.3-alpine@1"}},
+		{"ruby", "", 10, []string{}},
+	}
+	for _, test := range tests {
+		records, err := store.Query(ctx, test.name, test.tag, test.limit)
+		if err != nil {
+			t.Fatalf("unable to query %s:%s: %s", test.name, test.tag, err)
+		}
+		got := recordTimes(records, start)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:%s limit %d: want %v, got %v", test.name, test.tag, test.limit, test.want, got)
+		}
+	}
+
+	durations, err := historyDurations(ctx, store, []*DockerBuild{{Name: "php"}, {Name: "php"}})
+	if err != nil {
+		t.Fatalf("unable to read durations: %s", err)
+	}
+	want := map[string]time.Duration{"php:8.3-alpine": 62 * time.Second, "php:8.2": 30 * time.Second}
+	if !reflect.DeepEqual(durations, want) {
+		t.Errorf("durations: want %v, got %v", want, durations)
+	}
+}
+
+func TestFileHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "history.json")
+	start := historyRuns(t, NewHistoryStore(path, "", 2))
+
+	// a new store reads the records of the previous runs
+	testHistoryQueries(t, NewHistoryStore(path, "", 2), start)
+
+	err := os.WriteFile(path, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewHistoryStore(path, "", 2).Query(context.Background(), "php", "", 0)
+	if err == nil {
+		t.Errorf("expected an error for a corrupt history")
+	}
+}
+
+// newFakeHistoryService is a stand-in for a history service, it stores the
+// records in a history file
+func newFakeHistoryService(t *testing.T, token string) *httptest.Server {
+	store := NewHistoryStore(filepath.Join(t.TempDir(), "history.json"), "", 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/records" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			records := []*HistoryRecord{}
+			err := json.NewDecoder(r.Body).Decode(&records)
+			if err == nil {
+				err = store.Record(r.Context(), records)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		case http.MethodGet:
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			records, err := store.Query(r.Context(), r.URL.Query().Get("name"), r.URL.Query().Get("tag"), limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(records)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPHistory(t *testing.T) {
+	server := newFakeHistoryService(t, "secret-token")
+	start := historyRuns(t, NewHistoryStore(server.URL+"/", "secret-token", 0))
+	testHistoryQueries(t, NewHistoryStore(server.URL, "secret-token", 0), start)
+
+	_, err := NewHistoryStore(server.URL, "wrong", 0).Query(context.Background(), "php", "", 0)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	err = PrintHistory(context.Background(), NewHistoryStore(server.URL, "secret-token", 0), "php:8.3-alpine", 10, out)
+	if err != nil {
+		t.Fatalf("unable to print history: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "php:8.3-alpine  succeeded") || !strings.Contains(lines[2], "failed") {
+		t.Errorf("unexpected history:\n%s", out)
+	}
+}
+
+func TestInputHash(t *testing.T) {
+	dir := t.TempDir()
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	err := os.WriteFile(dockerfile, []byte("FROM alpine\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &DockerBuild{Path: dir, Dockerfile: dockerfile, Arguments: map[string]string{"VERSION": "8.3"}}
+	hash := b.inputHash()
+	if hash != b.inputHash() {
+		t.Errorf("hash is not stable")
+	}
+
+	changed := b.copy()
+	changed.Arguments["VERSION"] = "8.2"
+	if changed.inputHash() == hash {
+		t.Errorf("hash does not change with the arguments")
+	}
+
+	// the context is hashed once per run
+	writeFiles(t, dir, map[string]string{"entrypoint.sh": "#!/bin/sh\n"})
+	if b.inputHash() != hash {
+		t.Errorf("context was hashed again")
+	}
+	contextHashes.Clear()
+	if b.inputHash() == hash {
+		t.Errorf("hash does not change with the build context")
+	}
+
+	// files excluded by the .dockerignore are not sent to docker
+	writeFiles(t, dir, map[string]string{".dockerignore": "*.md\ntests\n"})
+	contextHashes.Clear()
+	hash = b.inputHash()
+	writeFiles(t, dir, map[string]string{"README.md": "# php\n", "tests/unit.sh": "#!/bin/sh\n"})
+	contextHashes.Clear()
+	if b.inputHash() != hash {
+		t.Errorf("hash changes with ignored files")
+	}
+	writeFiles(t, dir, map[string]string{".dockerignore": "*.md\n"})
+	contextHashes.Clear()
+	if b.inputHash() == hash {
+		t.Errorf("hash does not change with the .dockerignore")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// junitOutputLimit is the maximal size of the output of a testcase, the end
+// of the output is kept
+const junitOutputLimit = 64 * 1024
+
+type (
+	// junitTestsuites is the root element of a junit report
+	junitTestsuites struct {
+		XMLName  xml.Name          `xml:"testsuites"`
+		Name     string            `xml:"name,attr"`
+		Tests    int               `xml:"tests,attr"`
+		Failures int               `xml:"failures,attr"`
+		Skipped  int               `xml:"skipped,attr"`
+		Time     float64           `xml:"time,attr"`
+		Suites   []*junitTestsuite `xml:"testsuite"`
+	}
+
+	// junitTestsuite contains the builds of an image
+	junitTestsuite struct {
+		Name     string           `xml:"name,attr"`
+		Tests    int              `xml:"tests,attr"`
+		Failures int              `xml:"failures,attr"`
+		Errors   int              `xml:"errors,attr"`
+		Skipped  int              `xml:"skipped,attr"`
+		Time     float64          `xml:"time,attr"`
+		Cases    []*junitTestcase `xml:"testcase"`
+	}
+
+	// junitTestcase is a single build
+	junitTestcase struct {
+		Name      string        `xml:"name,attr"`
+		Classname string        `xml:"classname,attr"`
+		Time      float64       `xml:"time,attr"`
+		Failure   *junitMessage `xml:"failure,omitempty"`
+		Skipped   *junitMessage `xml:"skipped,omitempty"`
+		SystemOut *junitOutput  `xml:"system-out,omitempty"`
+	}
+
+	// junitMessage is a failure or the reason a testcase was skipped
+	junitMessage struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+
+	// junitOutput is the output of a build
+	junitOutput struct {
+		Text string `xml:",cdata"`
+	}
+)
+
+// truncateOutput keeps the last limit bytes of the output and removes the
+// characters that are not allowed in xml, i.e. terminal escape codes
+func truncateOutput(output []byte, limit int) string {
+	text := string(output)
+	if len(output) > limit {
+		text = fmt.Sprintf("[%d bytes truncated]\n%s", len(output)-limit, output[len(output)-limit:])
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(text, ""))
+}
+
+// testcase converts the build to a junit testcase
+func (b *DockerBuild) testcase() *junitTestcase {
+	testcase := &junitTestcase{
+		Name:      b.Tag,
+		Classname: b.Name,
+		Time:      b.duration().Seconds(),
+	}
+	if len(b.Output) > 0 {
+		testcase.SystemOut = &junitOutput{Text: truncateOutput(secrets.RedactBytes(b.Output), junitOutputLimit)}
+	}
+	switch b.status() {
+	case statusSucceeded:
+	case statusSkipped, statusCanceled:
+		testcase.Skipped = &junitMessage{Message: secrets.Redact(b.Error.Error())}
+	default:
+		message := secrets.Redact(b.Error.Error())
+		testcase.Failure = &junitMessage{Message: message, Text: message}
+	}
+	return testcase
+}
+
+// WriteJUnit writes a junit xml report with a testsuite per image and a
+// testcase per build to path. Builds skipped by the diff are reported as
+// skipped.
+func (f *Finisher) WriteJUnit(path string) error {
+	suites := map[string]*junitTestsuite{}
+	report := &junitTestsuites{Name: "drone-docker-matrix"}
+	add := func(b *DockerBuild, testcase *junitTestcase) {
+		suite, found := suites[b.Name]
+		if !found {
+			suite = &junitTestsuite{Name: b.Name}
+			suites[b.Name] = suite
+			report.Suites = append(report.Suites, suite)
+		}
+		suite.Cases = append(suite.Cases, testcase)
+		suite.Tests++
+		suite.Time += testcase.Time
+		report.Tests++
+		report.Time += testcase.Time
+		switch {
+		case testcase.Failure != nil:
+			suite.Failures++
+			report.Failures++
+		case testcase.Skipped != nil:
+			suite.Skipped++
+			report.Skipped++
+		}
+	}
+
+	for _, b := range f.results {
+		add(b, b.testcase())
+	}
+	for _, b := range f.unselected {
+		add(b, &junitTestcase{
+			Name:      b.Tag,
+			Classname: b.Name,
+			Skipped:   &junitMessage{Message: "unchanged"},
+		})
+	}
+
+	sort.Slice(report.Suites, func(i, j int) bool {
+		return report.Suites[i].Name < report.Suites[j].Name
+	})
+	for _, suite := range report.Suites {
+		sort.SliceStable(suite.Cases, func(i, j int) bool {
+			return suite.Cases[i].Name < suite.Cases[j].Name
+		})
+	}
+
+	content, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode junit report: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create junit directory: %w", err)
+	}
+	return os.WriteFile(path, []byte(xml.Header+strings.TrimSpace(string(content))+"\n"), 0644)
+}
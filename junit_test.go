@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	secrets.Add("npm-secret-value")
+	built := resultBuild("images", "php", "8.3", nil)
+	built.Output = []byte("step 1/2\n\x1b[1mdone\x1b[0m\n")
+	failed := resultBuild("images", "php", "8.2", errors.New("exit status 1: npm-secret-value"))
+	canceled := resultBuild("images", "php", "8.1", fmt.Errorf("build %w", context.Canceled))
+	skipped := resultBuild("images", "node", "22", fmt.Errorf("%w: php:8.2 failed", errSkipped))
+	skipped.Durations = nil
+	f := &Finisher{
+		results:    []*DockerBuild{built, failed, canceled, skipped},
+		unselected: []*DockerBuild{{Name: "node", Tag: "20"}},
+	}
+
+	path := filepath.Join(t.TempDir(), "reports", "junit.xml")
+	err := f.WriteJUnit(path)
+	if err != nil {
+		t.Fatalf("unable to write junit report: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<testsuites name="drone-docker-matrix" tests="5" failures="1" skipped="3" time="69">`,
+		`  <testsuite name="node" tests="2" failures="0" errors="0" skipped="2" time="0">`,
+		`    <testcase name="20" classname="node" time="0">`,
+		`      <skipped message="unchanged"></skipped>`,
+		`    </testcase>`,
+		`    <testcase name="22" classname="node" time="0">`,
+		`      <skipped message="skipped: php:8.2 failed"></skipped>`,
+		`    </testcase>`,
+		`  </testsuite>`,
+		`  <testsuite name="php" tests="3" failures="1" errors="0" skipped="1" time="69">`,
+		`    <testcase name="8.1" classname="php" time="23">`,
+		`      <skipped message="build context canceled"></skipped>`,
+		`    </testcase>`,
+		`    <testcase name="8.2" classname="php" time="23">`,
+		`      <failure message="exit status 1: ********">exit status 1: ********</failure>`,
+		`    </testcase>`,
+		`    <testcase name="8.3" classname="php" time="23">`,
+		`      <system-out><![CDATA[step 1/2`,
+		`[1mdone[0m`,
+		`]]></system-out>`,
+		`    </testcase>`,
+		`  </testsuite>`,
+		`</testsuites>`,
+		``,
+	}, "\n")
+	if string(content) != want {
+		t.Errorf("want junit report\n%s\ngot\n%s", want, content)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		limit  int
+		want   string
+	}{
+		{"short\n", 64, "short\n"},
+		{"first\nsecond\nthird\n", 6, "[13 bytes truncated]\nthird\n"},
+		{"\x1b[31mred\x1b[0m\ttab\r\n", 64, "[31mred[0m\ttab\r\n"},
+		{"invalid \xff utf-8", 64, "invalid  utf-8"},
+	}
+	for _, test := range tests {
+		if got := truncateOutput([]byte(test.output), test.limit); got != test.want {
+			t.Errorf("%q: want %q, got %q", test.output, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ociLabelPrefix is the prefix of the OCI image annotations
+	ociLabelPrefix = "org.opencontainers.image."
+
+	// revisionLabel stores the commit an image was built from
+	revisionLabel = ociLabelPrefix + "revision"
+)
+
+type (
+	// LabelData is available in the label and annotation templates
+	LabelData struct {
+		// Args are the build arguments of the image without the
+		// sensitive arguments
+		Args map[string]string
+		// Name is the image name and Tag the tag from the matrix
+		Name string
+		Tag  string
+		// Commit is the commit sha, Branch the branch and GitTag the git
+		// tag, Version is the git tag without a leading `v`
+		Commit  string
+		Branch  string
+		GitTag  string
+		Version string
+		// BuildNumber and BuildLink identify the drone build
+		BuildNumber string
+		BuildLink   string
+		RepoLink    string
+		// Created is the build time in RFC 3339 format
+		Created string
+	}
+)
+
+// commitSHA returns the commit sha of the build resolved at startup
+func commitSHA() string {
+	return c.Commit
+}
+
+// resolveCommitSHA returns the commit sha of the build, refs are never
+// returned. Without drone variables HEAD of the working directory is used.
+func resolveCommitSHA() string {
+	for _, env := range []string{"DRONE_COMMIT_SHA", "DRONE_COMMIT"} {
+		if sha := os.Getenv(env); isCommitSHA(sha) {
+			return sha
+		}
+	}
+	head, err := git(context.Background(), "rev-parse", "HEAD")
+	if err != nil || !isCommitSHA(head) {
+		return ""
+	}
+	return head
+}
+
+// labelData collects the template data for the build
+func labelData(b *DockerBuild) LabelData {
+	args := make(map[string]string, len(b.Arguments))
+	for key, value := range b.Arguments {
+		if !b.sensitive(key) {
+			args[key] = value
+		}
+	}
+	gitTag := os.Getenv("DRONE_TAG")
+	return LabelData{
+		Args:        args,
+		Name:        b.Name,
+		Tag:         b.Tag,
+		Commit:      commitSHA(),
+		Branch:      os.Getenv("DRONE_BRANCH"),
+		GitTag:      gitTag,
+		Version:     strings.TrimPrefix(gitTag, "v"),
+		BuildNumber: os.Getenv("DRONE_BUILD_NUMBER"),
+		BuildLink:   os.Getenv("DRONE_BUILD_LINK"),
+		RepoLink:    os.Getenv("DRONE_REPO_LINK"),
+		Created:     c.Time.Format(time.RFC3339),
+	}
+}
+
+// renderTemplates renders a map of templates for the build
+func renderTemplates(templates map[string]string, b *DockerBuild) (map[string]string, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+	data := labelData(b)
+	rendered := make(map[string]string, len(templates))
+	for key, text := range templates {
+		tmpl, err := parseTemplate(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %s: %w", key, err)
+		}
+		buffer := &bytes.Buffer{}
+		err = tmpl.Execute(buffer, data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render template for %s: %w", key, err)
+		}
+		rendered[key] = buffer.String()
+	}
+	return rendered, nil
+}
+
+// baseImage returns the base image of the last stage, following references
+// to earlier stages. Images based on scratch have no base image.
+func baseImage(b *DockerBuild) string {
+	stages := parseStages(b)
+	if len(stages) == 0 {
+		return ""
+	}
+	image := stages[len(stages)-1].Image
+	for i := len(stages) - 2; i >= 0; i-- {
+		if stages[i].Name == strings.ToLower(image) {
+			image = stages[i].Image
+		}
+	}
+	if strings.ToLower(image) == "scratch" {
+		return ""
+	}
+	return image
+}
+
+// resolveBaseDigest looks up the digest of the base image in the registry,
+// images pinned by digest are not looked up
+func (b *DockerBuild) resolveBaseDigest(ctx context.Context) {
+	if !c.BaseDigestLabel || registry == nil || b.BaseDigest != "" {
+		return
+	}
+	image := baseImage(b)
+	if image == "" {
+		return
+	}
+	if _, digest, found := strings.Cut(image, "@"); found {
+		b.BaseDigest = digest
+		return
+	}
+	ref, err := ParseReference(image)
+	if err != nil {
+		log.Debugf("%s unable to parse base image %s: %s", b.ID, image, err)
+		return
+	}
+	b.BaseDigest, err = registry.Digest(ctx, ref)
+	if err != nil {
+		log.Debugf("%s unable to resolve digest of %s: %s", b.ID, image, err)
+	}
+}
+
+// labels returns the labels of the image in a stable order
+func (b *DockerBuild) labels() []string {
+	labels := []string{}
+	add := func(key, value string) {
+		labels = append(labels, fmt.Sprintf("%s=%s", key, value))
+	}
+	addSet := func(key, value string) {
+		if value != "" {
+			add(key, value)
+		}
+	}
+
+	if c.LabelSchema {
+		add("org.label-schema.schema-version", "1.0")
+		add("org.label-schema.vcs-ref", commitSHA())
+		add("org.label-schema.vcs-url", os.Getenv("DRONE_REPO_LINK"))
+		add("org.label-schema.build-date", c.Time.Format(time.RFC3339))
+	}
+
+	if c.OCILabels {
+		source := os.Getenv("DRONE_GIT_HTTP_URL")
+		if source == "" {
+			source = os.Getenv("DRONE_REPO_LINK")
+		}
+		add(ociLabelPrefix+"created", c.Time.Format(time.RFC3339))
+		addSet(revisionLabel, commitSHA())
+		addSet(ociLabelPrefix+"source", source)
+		addSet(ociLabelPrefix+"url", os.Getenv("DRONE_REPO_LINK"))
+		add(ociLabelPrefix+"version", b.Tag)
+		add(ociLabelPrefix+"title", b.Name)
+		if base := baseImage(b); base != "" {
+			name, _, _ := strings.Cut(base, "@")
+			if ref, err := ParseReference(name); err == nil {
+				name = ref.String()
+			}
+			add(ociLabelPrefix+"base.name", name)
+			addSet(ociLabelPrefix+"base.digest", b.BaseDigest)
+		}
+	}
+
+	if id := tracer.TraceID(); id != "" {
+		add(traceLabel, id)
+	}
+
+	// matrix arguments, sensitive arguments are never stored
+	if c.ArgLabelPrefix != "" {
+		for _, arg := range b.ArgumentOrder {
+			if b.Arguments[arg] == "" || b.sensitive(arg) {
+				continue
+			}
+			add(c.ArgLabelPrefix+arg, b.Arguments[arg])
+		}
+	}
+
+	keys := make([]string, 0, len(b.Labels))
+	for key := range b.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(key, b.Labels[key])
+	}
+	return labels
+}
+
+// annotations returns the annotations of the image in a stable order
+func (b *DockerBuild) annotations() []string {
+	keys := make([]string, 0, len(b.Annotations))
+	for key := range b.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	annotations := make([]string, 0, len(keys))
+	for _, key := range keys {
+		annotations = append(annotations, fmt.Sprintf("%s=%s", key, b.Annotations[key]))
+	}
+	return annotations
+}
+
+// sensitive checks if the build argument is listed in `sensitive_args`
+func (b *DockerBuild) sensitive(arg string) bool {
+	for _, sensitive := range b.SensitiveArgs {
+		if sensitive == arg {
+			return true
+		}
+	}
+	return false
+}
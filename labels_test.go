@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// labelBuild creates a build with a sensitive argument and matrix labels
+func labelBuild(t *testing.T) *DockerBuild {
+	b := dependencyBuild(t, "php", "8.3-alpine", strings.Join([]string{
+		"FROM alpine:3.20 AS base",
+		"FROM golang:1.23 AS build",
+		"FROM base",
+	}, "\n"))
+	b.Arguments = map[string]string{"VERSION": "8.3", "OS": "", "NPM_TOKEN": "secret"}
+	b.ArgumentOrder = []string{"VERSION", "OS", "NPM_TOKEN"}
+	b.SensitiveArgs = []string{"NPM_TOKEN"}
+	return b
+}
+
+// setLabelEnv configures the drone variables used in labels
+func setLabelEnv(t *testing.T) {
+	oldConfig := c
+	t.Cleanup(func() { c = oldConfig })
+	c = config{Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Commit: strings.Repeat("a", 40)}
+	t.Setenv("DRONE_REPO_LINK", "https://git.example.com/org/images")
+	t.Setenv("DRONE_GIT_HTTP_URL", "https://git.example.com/org/images.git")
+	t.Setenv("DRONE_BRANCH", "main")
+	t.Setenv("DRONE_TAG", "v1.2.0")
+	t.Setenv("DRONE_BUILD_NUMBER", "7")
+	t.Setenv("DRONE_BUILD_LINK", "https://drone.example.com/org/images/7")
+}
+
+func TestLabels(t *testing.T) {
+	setLabelEnv(t)
+	b := labelBuild(t)
+	b.BaseDigest = "sha256:" + strings.Repeat("0", 64)
+	b.Labels = map[string]string{"org.example.b": "2", "org.example.a": "1"}
+
+	c.OCILabels = true
+	c.ArgLabelPrefix = "arg."
+	want := []string{
+		"org.opencontainers.image.created=2024-05-01T12:00:00Z",
+		"org.opencontainers.image.revision=" + strings.Repeat("a", 40),
+		"org.opencontainers.image.source=https://git.example.com/org/images.git",
+		"org.opencontainers.image.url=https://git.example.com/org/images",
+		"org.opencontainers.image.version=8.3-alpine",
+		"org.opencontainers.image.title=php",
+		"org.opencontainers.image.base.name=" + normalized(t, "alpine:3.20")[0],
+		"org.opencontainers.image.base.digest=sha256:" + strings.Repeat("0", 64),
+		"arg.VERSION=8.3",
+		"org.example.a=1",
+		"org.example.b=2",
+	}
+	if got := b.labels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want labels\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	// the label schema, without oci and argument labels
+	c.OCILabels = false
+	c.ArgLabelPrefix = ""
+	c.LabelSchema = true
+	b.Labels = nil
+	want = []string{
+		"org.label-schema.schema-version=1.0",
+		"org.label-schema.vcs-ref=" + strings.Repeat("a", 40),
+		"org.label-schema.vcs-url=https://git.example.com/org/images",
+		"org.label-schema.build-date=2024-05-01T12:00:00Z",
+	}
+	if got := b.labels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want labels\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestBaseImage(t *testing.T) {
+	tests := map[string]string{
+		"FROM alpine:3.20 AS base\nFROM golang AS build\nFROM base\n": "alpine:3.20",
+		"FROM golang AS build\nFROM scratch\n":                        "",
+		"FROM alpine@sha256:0000\n":                                   "alpine@sha256:0000",
+		"":                                                            "",
+	}
+	for dockerfile, want := range tests {
+		b := dependencyBuild(t, "php", "8.3", dockerfile)
+		if got := baseImage(b); got != want {
+			t.Errorf("%q: want %q, got %q", dockerfile, want, got)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	setLabelEnv(t)
+	b := labelBuild(t)
+
+	rendered, err := renderTemplates(map[string]string{
+		"version": "{{.Args.VERSION}}",
+		"image":   "{{.Name}}:{{.Tag}}",
+		"release": "{{.GitTag}} {{.Version}}",
+		"build":   "{{.BuildNumber}} {{.BuildLink}}",
+		"source":  "{{.RepoLink}}@{{.Branch}} {{.Commit}}",
+		"created": "{{.Created}}",
+	}, b)
+	if err != nil {
+		t.Fatalf("unable to render: %s", err)
+	}
+	want := map[string]string{
+		"version": "8.3",
+		"image":   "php:8.3-alpine",
+		"release": "v1.2.0 1.2.0",
+		"build":   "7 https://drone.example.com/org/images/7",
+		"source":  "https://git.example.com/org/images@main " + strings.Repeat("a", 40),
+		"created": "2024-05-01T12:00:00Z",
+	}
+	if !reflect.DeepEqual(rendered, want) {
+		t.Errorf("want %v, got %v", want, rendered)
+	}
+
+	if data := labelData(b); data.Args["NPM_TOKEN"] != "" || data.Args["VERSION"] != "8.3" {
+		t.Errorf("unexpected arguments %v", data.Args)
+	}
+	if b.Arguments["NPM_TOKEN"] != "secret" {
+		t.Errorf("the build arguments were modified")
+	}
+
+	tests := map[string]string{
+		"{{.Args.NPM_TOKEN}}": "unable to render template",
+		"{{.Missing}}":        "unable to render template",
+		"{{.Name":             "invalid template",
+	}
+	for text, want := range tests {
+		_, err := renderTemplates(map[string]string{"label": text}, b)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want error %q, got %v", text, want, err)
+		}
+	}
+
+	// the templates are parsed once for all builds
+	first, _ := parseTemplate("{{.Name}}:{{.Tag}}")
+	second, _ := parseTemplate("{{.Name}}:{{.Tag}}")
+	if first != second {
+		t.Errorf("template was parsed again")
+	}
+
+	rendered, err = renderTemplates(nil, b)
+	if rendered != nil || err != nil {
+		t.Errorf("expected nothing without templates, got %v %v", rendered, err)
+	}
+}
+
+func TestResolveCommitSHA(t *testing.T) {
+	sha := strings.Repeat("b", 40)
+	t.Setenv("DRONE_COMMIT_SHA", "")
+	t.Setenv("DRONE_COMMIT", sha)
+	if got := resolveCommitSHA(); got != sha {
+		t.Errorf("want %s, got %s", sha, got)
+	}
+
+	// refs are never used, HEAD of the working directory is the fallback
+	t.Setenv("DRONE_COMMIT", "refs/heads/main")
+	head, err := git(context.Background(), "rev-parse", "HEAD")
+	if err != nil {
+		t.Skipf("no git history: %s", err)
+	}
+	if got := resolveCommitSHA(); got != head {
+		t.Errorf("want HEAD %s, got %s", head, got)
+	}
+}
+
+func TestCopyLabels(t *testing.T) {
+	b := labelBuild(t)
+	b.Labels = map[string]string{"org.example.a": "1"}
+	b.Annotations = map[string]string{"org.example.b": "2"}
+	copied := b.copy()
+	copied.Labels["org.example.a"] = "changed"
+	copied.Annotations["org.example.c"] = "3"
+	if b.Labels["org.example.a"] != "1" || len(b.Annotations) != 1 {
+		t.Errorf("labels of the copy are shared: %v %v", b.Labels, b.Annotations)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultRegistryHost is the registry used by docker for names without a
+// registry host
+const defaultRegistryHost = "docker.io"
+
+// defaultRegistryServer is the address docker uses for credentials of
+// defaultRegistryHost
+const defaultRegistryServer = "https://index.docker.io/v1/"
+
+type (
+	// Credential is used to log in to a single registry host
+	Credential struct {
+		Host     string
+		Username string
+		Password string
+	}
+
+	// dockerConfig is the subset of the docker config.json used for logins
+	dockerConfig struct {
+		Auths map[string]dockerAuth `json:"auths"`
+	}
+	dockerAuth struct {
+		Auth     string `json:"auth,omitempty"`
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+	}
+)
+
+var nonAlnum = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// registryHost returns the registry host of an image name, i.e.
+// `registry.example.com:5000/images/php` returns `registry.example.com:5000`
+func registryHost(name string) string {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "https://"), "http://")
+	host, _, found := strings.Cut(name, "/")
+	if !found || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return defaultRegistryHost
+	}
+	return normalizeHost(host)
+}
+
+// normalizeHost maps the different docker hub spellings to
+// defaultRegistryHost
+func normalizeHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return defaultRegistryHost
+	}
+	return host
+}
+
+// loginEnvName returns the environment variable name for a credential
+// field of a registry, i.e. `PLUGIN_LOGIN_DOCKER_IO_USERNAME`
+func loginEnvName(host, field string) string {
+	sanitized := strings.Trim(nonAlnum.ReplaceAllString(strings.ToUpper(host), "_"), "_")
+	return fmt.Sprintf("PLUGIN_LOGIN_%s_%s", sanitized, field)
+}
+
+// loadCredentials collects the credentials for all registries from the
+// docker config json and the environment, the environment takes precedence
+func loadCredentials() (map[string]Credential, error) {
+	creds := map[string]Credential{}
+
+	if c.DockerConfigJSON != "" {
+		var config dockerConfig
+		err := json.Unmarshal([]byte(c.DockerConfigJSON), &config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse docker config json: %w", err)
+		}
+		for host, auth := range config.Auths {
+			cred := Credential{
+				Host:     normalizeHost(host),
+				Username: auth.Username,
+				Password: auth.Password,
+			}
+			if auth.Auth != "" {
+				secrets.Add(auth.Auth)
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decode auth for %s: %w", host, err)
+				}
+				cred.Username, cred.Password, _ = strings.Cut(string(decoded), ":")
+			}
+			creds[cred.Host] = cred
+		}
+	}
+
+	primary := registryHost(c.Registry + "/")
+	if c.Username != "" || c.Password != "" {
+		creds[primary] = Credential{
+			Host:     primary,
+			Username: c.Username,
+			Password: c.Password,
+		}
+	}
+
+	hosts := append([]string{primary}, c.Logins...)
+	for _, host := range hosts {
+		host = normalizeHost(host)
+		username := os.Getenv(loginEnvName(host, "USERNAME"))
+		password := os.Getenv(loginEnvName(host, "PASSWORD"))
+		if token := os.Getenv(loginEnvName(host, "TOKEN")); token != "" {
+			password = token
+			if username == "" {
+				username = "token"
+			}
+		}
+		if password == "" {
+			continue
+		}
+		creds[host] = Credential{
+			Host:     host,
+			Username: username,
+			Password: password,
+		}
+	}
+
+	for _, cred := range creds {
+		secrets.Add(cred.Password)
+	}
+	return creds, nil
+}
+
+// dockerConfigDir returns the docker config directory of the runner
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// isolatedConfig returns the docker config of the runner in source, so
+// registries logged in via the runner or a credential helper keep working.
+// If a credential store is configured the hosts are mapped to the file
+// store, so the logins of this run never leave the isolated config.
+func isolatedConfig(source string, hosts []string) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	path := filepath.Join(source, "config.json")
+	content, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(content, &config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse docker config %s: %w", path, err)
+		}
+	} else if source != "" && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read docker config: %w", err)
+	}
+	if _, found := config["auths"]; !found {
+		config["auths"] = json.RawMessage(`{}`)
+	}
+
+	_, store := config["credsStore"]
+	_, helpers := config["credHelpers"]
+	if (store || helpers) && len(hosts) > 0 {
+		credHelpers := map[string]string{}
+		if helpers {
+			err = json.Unmarshal(config["credHelpers"], &credHelpers)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse credHelpers of %s: %w", path, err)
+			}
+		}
+		for _, host := range hosts {
+			credHelpers[host] = ""
+			if host == defaultRegistryHost {
+				credHelpers[defaultRegistryServer] = ""
+			}
+		}
+		config["credHelpers"], err = json.Marshal(credHelpers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(config, "", "\t")
+}
+
+// login writes an isolated docker config for this run and logs in to all
+// registries with credentials. All failed registries are reported at once.
+// The existing config is copied and the other entries of the config
+// directory, i.e. cli plugins and buildx builders, are linked.
+func login(creds map[string]Credential) (configDir string, err error) {
+	hosts := make([]string, 0, len(creds))
+	for host := range creds {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	source := dockerConfigDir()
+	config, err := isolatedConfig(source, hosts)
+	if err != nil {
+		return "", err
+	}
+	configDir, err = os.MkdirTemp("", "drone-docker-matrix-")
+	if err != nil {
+		return "", fmt.Errorf("unable to create docker config directory: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(configDir, "config.json"), config, 0600)
+	if err != nil {
+		return configDir, fmt.Errorf("unable to write docker config: %w", err)
+	}
+	entries, _ := os.ReadDir(source)
+	for _, entry := range entries {
+		if entry.Name() == "config.json" {
+			continue
+		}
+		err = os.Symlink(filepath.Join(source, entry.Name()), filepath.Join(configDir, entry.Name()))
+		if err != nil {
+			log.Warnf("Unable to link docker config %s: %s", entry.Name(), err)
+		}
+	}
+
+	// child processes inherit the environment, so all docker commands use
+	// the isolated config
+	err = os.Setenv("DOCKER_CONFIG", configDir)
+	if err != nil {
+		return configDir, fmt.Errorf("unable to set DOCKER_CONFIG: %w", err)
+	}
+
+	failed := []string{}
+	for _, host := range hosts {
+		cred := creds[host]
+		cmd := exec.Command(c.Command, "login", "--username", cred.Username, "--password-stdin", cred.Host)
+		cmd.Stdin = strings.NewReader(cred.Password)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Errorf("Login failed   %s: %s\n%s", cred.Host, err, indent(secrets.Redact(string(out)), "  "))
+			failed = append(failed, cred.Host)
+			continue
+		}
+		log.Infof("Logged in      %s as %s", cred.Host, cred.Username)
+	}
+	if len(failed) > 0 {
+		return configDir, fmt.Errorf("unable to log in to registries: %s", strings.Join(failed, ", "))
+	}
+	return configDir, nil
+}
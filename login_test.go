@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoginKeepsRunnerConfig(t *testing.T) {
+	source := t.TempDir()
+	err := os.WriteFile(filepath.Join(source, "config.json"), []byte(`{
+		"auths": {"ghcr.io": {"auth": "dXNlcjpwYXNz"}},
+		"credsStore": "desktop",
+		"credHelpers": {"gcr.io": "gcloud"}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(source, "cli-plugins"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", source)
+	oldCommand := c.Command
+	c.Command = "true"
+	defer func() { c.Command = oldCommand }()
+
+	configDir, err := login(map[string]Credential{
+		"docker.io":            {Host: "docker.io", Username: "user", Password: "secret"},
+		"registry.example.com": {Host: "registry.example.com", Username: "user", Password: "secret"},
+	})
+	defer os.RemoveAll(configDir)
+	if err != nil {
+		t.Fatalf("unable to log in: %s", err)
+	}
+	if os.Getenv("DOCKER_CONFIG") != configDir {
+		t.Errorf("DOCKER_CONFIG is not the isolated config")
+	}
+
+	content, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := struct {
+		Auths       map[string]dockerAuth `json:"auths"`
+		CredsStore  string                `json:"credsStore"`
+		CredHelpers map[string]string     `json:"credHelpers"`
+	}{}
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Auths["ghcr.io"].Auth != "dXNlcjpwYXNz" || config.CredsStore != "desktop" {
+		t.Errorf("the config of the runner is not kept: %s", content)
+	}
+	wantHelpers := map[string]string{
+		"gcr.io":               "gcloud",
+		"docker.io":            "",
+		defaultRegistryServer:  "",
+		"registry.example.com": "",
+	}
+	if !reflect.DeepEqual(config.CredHelpers, wantHelpers) {
+		t.Errorf("want credHelpers %v, got %v", wantHelpers, config.CredHelpers)
+	}
+	target, err := os.Readlink(filepath.Join(configDir, "cli-plugins"))
+	if err != nil || target != filepath.Join(source, "cli-plugins") {
+		t.Errorf("cli plugins are not linked: %s %s", target, err)
+	}
+}
+
+func TestIsolatedConfigWithoutRunnerConfig(t *testing.T) {
+	config, err := isolatedConfig(t.TempDir(), []string{"docker.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(config) != "{\n\t\"auths\": {}\n}" {
+		t.Errorf("unexpected config %s", config)
+	}
+}
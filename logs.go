@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logColors are the ansi colors of the prefixes, picked per image
+var logColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// consoleMu keeps streamed lines of parallel builds from interleaving
+var consoleMu sync.Mutex
+
+type (
+	// buildOutput collects the output of a command of the build. Complete
+	// lines are streamed to the console with the prefix of the build and
+	// appended to the log file of the build.
+	buildOutput struct {
+		b       *DockerBuild
+		output  bytes.Buffer
+		partial []byte
+		file    *os.File
+	}
+)
+
+// logPrefix returns the console prefix of the build, i.e. `[php:8.3]`
+func (b *DockerBuild) logPrefix() string {
+	prefix := fmt.Sprintf("[%s]", b.prettyName())
+	if !c.LogColor {
+		return prefix
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(b.Name))
+	color := logColors[hash.Sum32()%uint32(len(logColors))]
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, prefix)
+}
+
+// logPath returns the path of the log file, `<logdir>/<name>/<tag>.log`
+func (b *DockerBuild) logPath() string {
+	return filepath.Join(c.LogDir, b.Name, b.Tag+".log")
+}
+
+// newOutput creates the output of the next command of the build, the log
+// file is truncated by the first command of the build
+func (b *DockerBuild) newOutput() *buildOutput {
+	o := &buildOutput{b: b}
+	if c.LogDir == "" {
+		return o
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !b.logStarted {
+		flags |= os.O_TRUNC
+	}
+	path := b.logPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		o.file, err = os.OpenFile(path, flags, 0644)
+	}
+	if err != nil {
+		log.Warnf("%s unable to open log file %s: %s", b.ID, path, err)
+		return o
+	}
+	b.logStarted = true
+	return o
+}
+
+// Write collects the output and handles all complete lines
+func (o *buildOutput) Write(content []byte) (int, error) {
+	o.output.Write(content)
+	o.partial = append(o.partial, content...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.line(o.partial[:i+1])
+		o.partial = o.partial[i+1:]
+	}
+	return len(content), nil
+}
+
+// line writes a complete line to the log file and the console
+func (o *buildOutput) line(line []byte) {
+	line = secrets.RedactBytes(line)
+	if o.file != nil {
+		_, _ = o.file.Write(line)
+	}
+	if !c.LogStream || o.b.truncated {
+		return
+	}
+	if c.LogConsoleLimit > 0 && o.b.echoed+len(line) > c.LogConsoleLimit {
+		o.b.truncated = true
+		line = []byte(fmt.Sprintf("output truncated after %d bytes", o.b.echoed))
+		if o.file != nil {
+			line = append(line, fmt.Sprintf(", see %s", o.b.logPath())...)
+		}
+		line = append(line, '\n')
+	}
+	o.b.echoed += len(line)
+
+	// the console is written directly, bypassing the redacting formatter
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	fmt.Fprintf(secrets.Writer(log.StandardLogger().Out), "%s %s", o.b.logPrefix(), line)
+}
+
+// Close handles the last incomplete line, closes the log file and returns
+// the redacted output
+func (o *buildOutput) Close() []byte {
+	if len(o.partial) > 0 {
+		o.line(append(o.partial, '\n'))
+		o.partial = nil
+	}
+	if o.file != nil {
+		err := o.file.Close()
+		if err != nil {
+			log.Warnf("%s unable to write log file: %s", o.b.ID, err)
+		}
+	}
+	return secrets.RedactBytes(o.output.Bytes())
+}
+
+// consoleOutput returns the output to log after a stage. Streamed output
+// is only repeated for failures that were truncated on the console, the
+// output of successful builds is limited to LogConsoleLimit.
+func (b *DockerBuild) consoleOutput(failed bool) string {
+	switch {
+	case c.LogStream && !(failed && b.truncated):
+		return ""
+	case failed || c.LogConsoleLimit <= 0 || len(b.Output) <= c.LogConsoleLimit:
+		return indent(string(b.Output), "  ")
+	}
+	return indent(truncateOutput(b.Output, c.LogConsoleLimit), "  ")
+}
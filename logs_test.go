@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// captureConsole redirects the console output to a buffer
+func captureConsole(t *testing.T) *bytes.Buffer {
+	console := &bytes.Buffer{}
+	oldOutput := log.StandardLogger().Out
+	log.SetOutput(console)
+	t.Cleanup(func() { log.SetOutput(oldOutput) })
+	return console
+}
+
+func TestBuildOutput(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{LogStream: true, LogDir: t.TempDir(), LogConsoleLimit: 40}
+	console := captureConsole(t)
+	secrets.Add("output-secret-value")
+	b := &DockerBuild{Name: "php", Tag: "8.3"}
+
+	// lines are streamed once complete, the console is limited
+	output := b.newOutput()
+	for _, chunk := range []string{"step 1/3\nstep ", "2/3 output-secret-value\n", "step 3/3 with a long line\n", "done"} {
+		_, _ = output.Write([]byte(chunk))
+	}
+	got := string(output.Close())
+	want := "step 1/3\nstep 2/3 ********\nstep 3/3 with a long line\ndone"
+	if got != want {
+		t.Errorf("want output %q, got %q", want, got)
+	}
+	want = strings.Join([]string{
+		"[php:8.3] step 1/3",
+		"[php:8.3] step 2/3 ********",
+		"[php:8.3] output truncated after 27 bytes, see " + b.logPath(),
+		"",
+	}, "\n")
+	if console.String() != want {
+		t.Errorf("want console\n%s\ngot\n%s", want, console.String())
+	}
+	content, err := os.ReadFile(b.logPath())
+	if err != nil || string(content) != "step 1/3\nstep 2/3 ********\nstep 3/3 with a long line\ndone\n" {
+		t.Errorf("unexpected log file %q: %v", content, err)
+	}
+
+	// the next command of the build appends to the log file
+	output = b.newOutput()
+	_, _ = output.Write([]byte("pushed\n"))
+	output.Close()
+	content, _ = os.ReadFile(b.logPath())
+	if !strings.HasSuffix(string(content), "done\npushed\n") {
+		t.Errorf("log file not appended %q", content)
+	}
+	if filepath.Dir(b.logPath()) != filepath.Join(c.LogDir, "php") {
+		t.Errorf("unexpected log path %s", b.logPath())
+	}
+}
+
+func TestConsoleOutput(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	tests := []struct {
+		stream    bool
+		limit     int
+		failed    bool
+		truncated bool
+		want      string
+	}{
+		{false, 0, false, false, "  line 1\n  line 2\n  \n"},
+		{false, 8, true, false, "  line 1\n  line 2\n  \n"},
+		{false, 8, false, false, "  [6 bytes truncated]\n  \n  line 2\n  \n"},
+		{true, 8, false, true, ""},
+		{true, 8, true, false, ""},
+		{true, 8, true, true, "  line 1\n  line 2\n  \n"},
+	}
+	for _, test := range tests {
+		c = config{LogStream: test.stream, LogConsoleLimit: test.limit}
+		b := &DockerBuild{Output: []byte("line 1\nline 2\n"), truncated: test.truncated}
+		if got := b.consoleOutput(test.failed); got != test.want {
+			t.Errorf("%+v: want %q, got %q", test, test.want, got)
+		}
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	r := &Redactor{}
+	r.Add("writer-secret")
+	out := &bytes.Buffer{}
+	n, err := r.Writer(out).Write([]byte("token writer-secret\n"))
+	if err != nil || n != 20 || out.String() != "token ********\n" {
+		t.Errorf("unexpected write %d %v: %q", n, err, out.String())
+	}
+}
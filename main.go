@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 
-	"net/http"
 
 	"github.com/drone/envsubst"
 	"github.com/kelseyhightower/envconfig"
@@ -19,17 +20,134 @@ type (
 	config struct {
 		// Registry is the registry to upload the images to
 		Registry string `envconfig:"REGISTRY"`
+		// Mode is `build` to build and upload changed images, `promote`
+		// to copy the images of PromoteFrom to their tags or `cleanup` to
+		// delete stale tags
+		Mode string `envconfig:"MODE" default:"build"`
+		// PromoteFrom is the build id to promote, i.e. `b123`, promoting
+		// an older build id rolls the tags back
+		PromoteFrom string `envconfig:"PROMOTE_FROM"`
+		// PromoteEvent is the tag policy event of the build that pushed
+		// PromoteFrom, its tags are promoted
+		PromoteEvent string `envconfig:"PROMOTE_EVENT" default:"default"`
+		// PromoteRegistry replaces Registry for the promoted tags
+		PromoteRegistry string `envconfig:"PROMOTE_REGISTRY"`
+		// PromoteImages limits the promotion to images by name or
+		// `name:tag`, empty promotes all images
+		PromoteImages []string `envconfig:"PROMOTE_IMAGES"`
+		// CleanupKeepBuilds is the number of build id tags kept per tag
+		// in cleanup mode, 0 keeps all
+		CleanupKeepBuilds int `envconfig:"CLEANUP_KEEP_BUILDS" default:"10"`
+		// CleanupOrphanDays deletes tags that are not part of the matrix
+		// anymore after the days, 0 keeps them
+		CleanupOrphanDays int `envconfig:"CLEANUP_ORPHAN_DAYS" default:"0"`
+		// CleanupProtected are glob patterns of tags that are never
+		// deleted
+		CleanupProtected []string `envconfig:"CLEANUP_PROTECTED" default:"latest"`
+		// CleanupBuildID is a regular expression matching the build id
+		// part of a tag, derived from TagBuildID if empty
+		CleanupBuildID string `envconfig:"CLEANUP_BUILD_ID"`
+		// DryRun only logs what would be promoted or deleted
+		DryRun bool `envconfig:"DRY_RUN" default:"false"`
+		// Username and Password are used to log in to Registry
+		Username string `envconfig:"USERNAME"`
+		Password string `envconfig:"PASSWORD"`
+		// Logins is a list of additional registry hosts to log in to,
+		// credentials are read from PLUGIN_LOGIN_<HOST>_USERNAME,
+		// PLUGIN_LOGIN_<HOST>_PASSWORD or PLUGIN_LOGIN_<HOST>_TOKEN
+		Logins []string `envconfig:"LOGINS"`
+		// DockerConfigJSON is the content of a docker config.json whose
+		// auths are used to log in
+		DockerConfigJSON string `envconfig:"DOCKER_CONFIG_JSON"`
+		// RegistryAPI pushes each image once per registry and creates the
+		// other tags via the registry api
+		RegistryAPI bool `envconfig:"REGISTRY_API" default:"false"`
+		// InsecureRegistries are contacted via plain http by the registry
+		// api client
+		InsecureRegistries []string `envconfig:"INSECURE_REGISTRIES"`
+		// BuildAttempts and UploadAttempts are the maximal attempts for
+		// each build and each push, failures are only retried if the
+		// exit code is in RetryExitCodes or the output matches a
+		// temporary error or RetryPatterns
+		BuildAttempts  int `envconfig:"BUILD_ATTEMPTS" default:"1"`
+		UploadAttempts int `envconfig:"UPLOAD_ATTEMPTS" default:"3"`
+		// RetryBackoff is the delay before the first retry, it doubles
+		// with each attempt up to RetryMaxBackoff
+		RetryBackoff    time.Duration `envconfig:"RETRY_BACKOFF" default:"5s"`
+		RetryMaxBackoff time.Duration `envconfig:"RETRY_MAX_BACKOFF" default:"2m"`
+		// RetryJitter randomizes the backoff by the fraction
+		RetryJitter    float64 `envconfig:"RETRY_JITTER" default:"0.2"`
+		RetryExitCodes []int   `envconfig:"RETRY_EXIT_CODES"`
+		// RetryPatterns are separated by newlines, regular expressions
+		// may contain commas
+		RetryPatterns string `envconfig:"RETRY_PATTERNS"`
+		// Timeout limits the whole run, 0 disables the limit
+		Timeout time.Duration `envconfig:"TIMEOUT" default:"0"`
+		// BuildTimeout limits each build and each upload of an image, it
+		// can be overwritten per image in `docker-matrix.yml`
+		BuildTimeout time.Duration `envconfig:"BUILD_TIMEOUT" default:"0"`
+		// FailMode cancels remaining builds after the first failure:
+		// `fast` cancels all builds, `group` cancels the builds of the
+		// same image, empty builds everything
+		FailMode string `envconfig:"FAIL_MODE"`
 		// PushGateway is the URL to Prometheus Pushgateway for metrics
 		PushGateway string `envconfig:"PUSHGATEWAY" default:""`
+		// PushGatewayJob is the job grouping key of the metrics
+		PushGatewayJob string `envconfig:"PUSHGATEWAY_JOB" default:"drone-docker-matrix"`
+		// Progress reports the progress of the run, `auto` renders a live
+		// view on terminals and prints a line every ProgressInterval
+		// otherwise, `plain` always prints lines, `tty` always renders
+		// the live view and `off` disables it
+		Progress         string        `envconfig:"PROGRESS" default:"auto"`
+		ProgressInterval time.Duration `envconfig:"PROGRESS_INTERVAL" default:"30s"`
+		// LogStream streams the output of each build line by line with
+		// the name of the build as prefix, LogColor colors the prefix
+		// per image
+		LogStream bool `envconfig:"LOG_STREAM" default:"false"`
+		LogColor  bool `envconfig:"LOG_COLOR" default:"false"`
+		// LogDir stores the output of each build in
+		// `<logdir>/<name>/<tag>.log`, skipped if empty
+		LogDir string `envconfig:"LOG_DIR"`
+		// LogConsoleLimit limits the output of a successful build on the
+		// console in bytes, 0 disables the limit
+		LogConsoleLimit int `envconfig:"LOG_CONSOLE_LIMIT" default:"0"`
+		// History stores the outcome of each build, a json file or the
+		// url of a history service, skipped if empty
+		History      string `envconfig:"HISTORY"`
+		HistoryToken string `envconfig:"HISTORY_TOKEN"`
+		// HistoryKeep is the number of records per tag in a history file
+		HistoryKeep int `envconfig:"HISTORY_KEEP" default:"50"`
+		// HistoryQuery is the `name` or `name:tag` printed by the history
+		// mode, HistoryLimit the number of records
+		HistoryQuery string `envconfig:"HISTORY_QUERY"`
+		HistoryLimit int    `envconfig:"HISTORY_LIMIT" default:"10"`
+		// Events is the target of the json event stream, a file, a unix
+		// socket `unix:///path` or an http endpoint, skipped if empty
+		Events string `envconfig:"EVENTS"`
+		// TraceEndpoint is the OTLP/HTTP endpoint of the collector the
+		// spans of the run are exported to, i.e. `http://otel:4318`
+		TraceEndpoint string   `envconfig:"TRACE_ENDPOINT"`
+		TraceHeaders  []string `envconfig:"TRACE_HEADERS"`
+		// TraceFile is the path the spans are written to in the OTLP json
+		// format, skipped if empty
+		TraceFile string `envconfig:"TRACE_FILE"`
+		// MetricsFile is the path of the metrics in the textfile format of
+		// the node exporter, skipped if empty
+		MetricsFile string `envconfig:"METRICS_FILE"`
 
 		BuildPoolSize  int `envconfig:"BUILD_POOL_SIZE" default:"4"`
 		UploadPoolSize int `envconfig:"UPLOAD_POOL_SIZE" default:"4"`
+		// FairShare limits the parallel builds of one image while builds
+		// of other images wait, 0 disables the limit
+		FairShare int `envconfig:"FAIR_SHARE" default:"0"`
 
 		// DefaultNamespace is the Namespace to use if not specified in
 		// `docker-matrix.yml` (default: `images`)
 		DefaultNamespace string `envconfig:"DEFAULT_NAMESPACE" default:"images"`
 		// TagName is the default tag name
 		TagName string `envconfig:"TAG_NAME" default:"latest"`
+		// TagPolicy contains the tag templates per drone event
+		TagPolicy TagPolicy `envconfig:"TAG_POLICY"`
 		// TagBuildID generates an additional tag `tagname-b<ID>` for
 		// each tag, skipped if empty
 		TagBuildID string `envconfig:"TAG_BUILD_ID"`
@@ -37,6 +155,16 @@ type (
 		SkipUpload bool `envconfig:"SKIP_UPLOAD" default:"false"`
 		// Pull trues to pull all docker images
 		Pull bool `envconfig:"PULL" default:"true"`
+		// OCILabels adds the `org.opencontainers.image.*` labels and
+		// LabelSchema the deprecated `org.label-schema.*` labels
+		OCILabels   bool `envconfig:"OCI_LABELS" default:"true"`
+		LabelSchema bool `envconfig:"LABEL_SCHEMA" default:"true"`
+		// BaseDigestLabel looks up the digest of the base image in the
+		// registry for the `base.digest` label
+		BaseDigestLabel bool `envconfig:"BASE_DIGEST_LABEL" default:"true"`
+		// ArgLabelPrefix adds each build argument as label with the
+		// prefix, empty disables the labels
+		ArgLabelPrefix string `envconfig:"ARG_LABEL_PREFIX" default:"com.github.bitsbeats.docker-matrix.arg."`
 
 		// Workdir changes the working directory before calculating the
 		// matrix
@@ -44,16 +172,48 @@ type (
 		// DiffOnly builds only changes, if no change is detected
 		// nothing will be build
 		DiffOnly bool `envconfig:"DIFF_ONLY" default:"true"`
+		// DiffBase is the commit to diff against, it overwrites all
+		// other detection
+		DiffBase string `envconfig:"DIFF_BASE"`
+		// DiffMode `last-success` diffs against the commit of the last
+		// successful run, from DiffStateFile or DiffStateImage
+		DiffMode string `envconfig:"DIFF_MODE"`
+		// ResultFile is the path of the json result of all builds, i.e.
+		// `.drone/images.json`, skipped if empty
+		ResultFile string `envconfig:"RESULT_FILE"`
+		// JUnitFile is the path of a junit xml report of all builds,
+		// skipped if empty
+		JUnitFile string `envconfig:"JUNIT_FILE"`
+		// SummaryFile is the path of a markdown report of all builds,
+		// skipped if empty
+		SummaryFile string `envconfig:"SUMMARY_FILE"`
+		// CardSchema is the url of the adaptive card template of the drone
+		// card, the card is skipped without it
+		CardSchema string `envconfig:"CARD_SCHEMA"`
+		// DiffStateFile stores the commit of the last successful run
+		DiffStateFile string `envconfig:"DIFF_STATE_FILE"`
+		// DiffStateImage is an image whose vcs-ref label is used as the
+		// commit of the last successful run
+		DiffStateImage string `envconfig:"DIFF_STATE_IMAGE"`
+		// DefaultBranch is used for the merge-base if DRONE_TARGET_BRANCH
+		// is not set, defaults to DRONE_REPO_BRANCH and `master`
+		DefaultBranch string `envconfig:"DEFAULT_BRANCH"`
 		// Dronetigger builds all images, regardless of other options
 		Dronetrigger bool `envconfig:"DRONETRIGGER" default:"false"`
 		// Command is the command to build dockerimages with
 		Command string `default:"docker"`
 		// Debug enables debuglogging
 		Debug bool `envconfig:"DEBUG" default:"false"`
+		// SecretEnvs is a list of environment variables whose values are
+		// masked in all output, variables ending in _PASSWORD, _TOKEN
+		// and _SECRET are always masked
+		SecretEnvs []string `envconfig:"SECRET_ENVS"`
 
 		// Time is set during startup and is used as Label on the
 		// indiviual images
 		Time time.Time
+		// Commit is the commit sha of the build, resolved during startup
+		Commit string `ignored:"true"`
 	}
 
 )
@@ -62,27 +222,160 @@ var c config
 
 func main() {
 	// configuration
-	log.SetFormatter(&log.TextFormatter{ForceColors: true})
+	log.SetFormatter(&redactFormatter{
+		Formatter: &log.TextFormatter{ForceColors: true},
+		redactor:  secrets,
+	})
 	err := envconfig.Process("plugin", &c)
 	if err != nil {
 		log.Fatalf("unable to parse environment: %s", err)
 	}
+	// all configured secrets are masked before anything is logged
+	secrets.AddEnv(c.SecretEnvs)
+	for _, secret := range configSecrets(c) {
+		secrets.Add(secret)
+	}
 	if c.BuildPoolSize < 1 || c.UploadPoolSize < 1 {
 		log.Fatalf("PoolSize may not be smaller than 1: BuildPoolSize: %d, UploadPoolSize: %d", c.BuildPoolSize, c.UploadPoolSize)
 	}
+	if c.FairShare < 0 {
+		log.Fatalf("FairShare may not be negative: %d", c.FairShare)
+	}
 	if c.Registry == "" {
 		log.Fatalf("Please specify a registry.")
 	}
+	err = c.TagPolicy.Validate()
+	if err != nil {
+		log.Fatalf("invalid tag policy: %s", err)
+	}
+	if c.CleanupBuildID == "" {
+		c.CleanupBuildID = buildIDPattern(c.TagBuildID)
+	}
 	c.TagBuildID, err = envsubst.EvalEnv(c.TagBuildID)
 	if err != nil {
 		log.Fatal(err)
 	}
+	c.PromoteFrom, err = envsubst.EvalEnv(c.PromoteFrom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !knownEvent(c.PromoteEvent) {
+		log.Fatalf("Unknown promote event %q", c.PromoteEvent)
+	}
+	if c.Mode != modeBuild && c.Mode != modePromote && c.Mode != modeCleanup && c.Mode != modeHistory {
+		log.Fatalf("Unknown mode %q", c.Mode)
+	}
+	switch c.Progress {
+	case progressAuto, progressPlain, progressTTY, progressOff:
+	default:
+		log.Fatalf("Unknown progress %q", c.Progress)
+	}
+	buildRetry, err = NewRetryPolicy(c.BuildAttempts, c.RetryBackoff, c.RetryMaxBackoff, c.RetryJitter, c.RetryExitCodes, splitLines(c.RetryPatterns))
+	if err != nil {
+		log.Fatalf("unable to parse retry patterns: %s", err)
+	}
+	uploadRetry, err = NewRetryPolicy(c.UploadAttempts, c.RetryBackoff, c.RetryMaxBackoff, c.RetryJitter, c.RetryExitCodes, splitLines(c.RetryPatterns))
+	if err != nil {
+		log.Fatalf("unable to parse retry patterns: %s", err)
+	}
 	if c.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
 	c.Time = time.Now()
+	c.Commit = resolveCommitSHA()
 	log.Infof("Configuration: %+v", c)
 
+	// log in to all registries before anything is built
+	creds, err := loadCredentials()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(creds) > 0 {
+		configDir, err := login(creds)
+		// the config holds the credentials, it is removed on all exits
+		// including log.Fatal
+		if configDir != "" {
+			log.RegisterExitHandler(func() { os.RemoveAll(configDir) })
+			defer os.RemoveAll(configDir)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	registry = NewRegistryClient(creds, c.InsecureRegistries)
+	if c.DiffStateFile != "" {
+		c.DiffStateFile, err = filepath.Abs(c.DiffStateFile)
+		if err != nil {
+			log.Fatalf("unable to resolve diff state file: %s", err)
+		}
+	}
+	if c.ResultFile != "" {
+		c.ResultFile, err = filepath.Abs(c.ResultFile)
+		if err != nil {
+			log.Fatalf("unable to resolve result file: %s", err)
+		}
+	}
+	if c.JUnitFile != "" {
+		c.JUnitFile, err = filepath.Abs(c.JUnitFile)
+		if err != nil {
+			log.Fatalf("unable to resolve junit file: %s", err)
+		}
+	}
+	if c.SummaryFile != "" {
+		c.SummaryFile, err = filepath.Abs(c.SummaryFile)
+		if err != nil {
+			log.Fatalf("unable to resolve summary file: %s", err)
+		}
+	}
+	if c.MetricsFile != "" {
+		c.MetricsFile, err = filepath.Abs(c.MetricsFile)
+		if err != nil {
+			log.Fatalf("unable to resolve metrics file: %s", err)
+		}
+	}
+	if c.LogDir != "" {
+		c.LogDir, err = filepath.Abs(c.LogDir)
+		if err != nil {
+			log.Fatalf("unable to resolve log dir: %s", err)
+		}
+	}
+	if c.TraceFile != "" {
+		c.TraceFile, err = filepath.Abs(c.TraceFile)
+		if err != nil {
+			log.Fatalf("unable to resolve trace file: %s", err)
+		}
+	}
+	if c.History != "" {
+		if !strings.HasPrefix(c.History, "http://") && !strings.HasPrefix(c.History, "https://") {
+			c.History, err = filepath.Abs(c.History)
+			if err != nil {
+				log.Fatalf("unable to resolve history file: %s", err)
+			}
+		}
+		history = NewHistoryStore(c.History, c.HistoryToken, c.HistoryKeep)
+	}
+	if c.Mode == modeHistory {
+		if history == nil {
+			log.Fatal("history mode requires a history")
+		}
+		err = PrintHistory(context.Background(), history, c.HistoryQuery, c.HistoryLimit, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	events, err = NewEventStream(c.Events)
+	if err != nil {
+		log.Fatalf("unable to set up events: %s", err)
+	}
+	if c.TraceEndpoint != "" || c.TraceFile != "" {
+		tracer, err = NewTracer(c.TraceEndpoint, c.TraceFile, c.TraceHeaders)
+		if err != nil {
+			log.Fatalf("unable to set up tracing: %s", err)
+		}
+		log.Infof("Tracing        %s", tracer.TraceID())
+	}
+
 	// log info
 	sysinfo := exec.Command(c.Command, "system", "info")
 	sysinfo.Stdout = os.Stdout
@@ -91,32 +384,88 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// stop on SIGINT and SIGTERM, and after the global timeout
+	ctx, cancel := runContext(c.Timeout)
+	defer cancel()
+
+	// promote or clean up
+	switch c.Mode {
+	case modePromote:
+		err = Promote(ctx, c.Workdir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case modeCleanup:
+		err = Cleanup(ctx, c.Workdir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// run
+	progress := NewProgress(c.Progress, c.ProgressInterval)
+	if progress != nil {
+		events.Subscribe(progress.observe)
+	}
 	b := NewBuilder(
 		builder,
 		uploader,
 		finisher,
+		progress,
 	)
-	err = b.Run(c.Workdir)
+	err = b.Run(ctx, c.Workdir)
+
+	// report metrics and traces, even of canceled runs
+	if c.PushGateway != "" {
+		pushErr := b.finish.PushMetrics(context.WithoutCancel(ctx))
+		if pushErr != nil {
+			log.Warnf("Unable to push metrics: %s", pushErr)
+		}
+	}
+	if c.MetricsFile != "" {
+		writeErr := b.finish.WriteMetrics(c.MetricsFile)
+		if writeErr != nil {
+			log.Warnf("Unable to write metrics: %s", writeErr)
+		}
+	}
+	flushErr := tracer.Flush(context.WithoutCancel(ctx))
+	if flushErr != nil {
+		log.Warnf("Unable to export traces: %s", flushErr)
+	}
+	closeErr := events.Close()
+	if closeErr != nil {
+		log.Warnf("Unable to close events: %s", closeErr)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 // build an image
-func builder(b *DockerBuild) {
-	err := b.build()
-	outStr := indent(string(b.Output), "  ")
+func builder(ctx context.Context, b *DockerBuild) {
+	ctx, cancel := withTimeout(ctx, b.Timeout)
+	defer cancel()
+	err := buildRetry.Do(ctx, b, "build", func() ([]byte, error) {
+		err := b.build(ctx)
+		return b.Output, err
+	})
+	if ctxErr := context.Cause(ctx); err != nil && ctxErr != nil {
+		err = fmt.Errorf("%w: %s", ctxErr, err)
+	}
+	outStr := b.consoleOutput(err != nil)
 	if err != nil {
 		b.Error = err
 		log.Errorf("Build failed   %s, %s\n  >> Arguments: %s\n%s\n", b.prettyName(), err, b.args(), outStr)
 		return
 	}
+	b.inspect(ctx)
 	log.Debugf("Build success  %s\n  >> Arguments: %s\n%s\n", b.prettyName(), b.args(), outStr)
 }
 
 // upload an image
-func uploader(b *DockerBuild) {
+func uploader(ctx context.Context, b *DockerBuild) {
 	// skip all uploads even if only a single build failes
 	if b.Error != nil {
 		return
@@ -125,8 +474,13 @@ func uploader(b *DockerBuild) {
 	if c.SkipUpload {
 		return
 	}
-	err := b.upload()
-	outStr := indent(string(b.Output), "  ")
+	ctx, cancel := withTimeout(ctx, b.Timeout)
+	defer cancel()
+	err := b.upload(ctx)
+	if ctxErr := context.Cause(ctx); err != nil && ctxErr != nil {
+		err = fmt.Errorf("%w: %s", ctxErr, err)
+	}
+	outStr := b.consoleOutput(err != nil)
 	if err != nil {
 		b.Error = err
 		log.Errorf("Upload failed  %s\n%s\n", b.prettyName(), outStr)
@@ -136,25 +490,9 @@ func uploader(b *DockerBuild) {
 }
 
 // finisher is called after an image is uploaded
-func finisher(b *DockerBuild) {
+func finisher(ctx context.Context, b *DockerBuild) {
 	log.Infof("Done           %s", b.prettyName())
-
-	// notify pushgateway if set
-	if c.PushGateway != "" {
-		// skip update if any of the tags failed
-		if b.Error != nil {
-			return
-		}
-
-		buffer := bytes.NewBuffer([]byte("# TYPE drone_docker_matrix gauge\n"))
-		for _, tag := range b.tags() {
-			fmt.Fprintf(buffer, "drone_docker_matrix{tag=%q} %d\n", tag, c.Time.Unix())
-		}
-		url := fmt.Sprintf(
-			"%s/job/drone-docker-matrix/image/%s",
-			c.PushGateway,
-			b.Name,
-		)
-		_, _ = http.Post(url, "text", bytes.NewReader(buffer.Bytes()))
+	if flaky := b.flaky(); len(flaky) > 0 {
+		log.Warnf("Flaky          %s (%s)", b.prettyName(), strings.Join(flaky, ", "))
 	}
 }
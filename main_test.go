@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -23,21 +24,23 @@ func TestBuild(t *testing.T) {
 		TagName:          "latest",
 		TagBuildID:       "7",
 		Command:          "echo",
+		LabelSchema:      true,
 		Workdir:          "testdata",
 		PushGateway:      "http://vm277.netzmarkt.lan:27121/metrics",
 		Time:             time.Now(),
+		Commit:           "279d9035886d4c0427549863c4c2101e4a63e041",
 	}
 
 	os.Setenv("VERSION_FROM_ENV", "7.3")
 	os.Setenv("NAME_FROM_ENV", "test")
-	os.Setenv("DRONE_COMMIT_REF", "279d9035886d4c0427549863c4c2101e4a63e041")
+	os.Setenv("DRONE_COMMIT_SHA", "279d9035886d4c0427549863c4c2101e4a63e041")
 	os.Setenv("DRONE_REPO_LINK", "octocat/matrixed")
 
 	var got string
 	b := NewBuilder(
 		builder,
 		uploader,
-		func(b *DockerBuild) {
+		func(ctx context.Context, b *DockerBuild) {
 			got += string(b.Output)
 			log.Infof("Done           %s", b.prettyName())
 
@@ -55,8 +58,9 @@ func TestBuild(t *testing.T) {
 				_, _ = http.Post(url, "text", bytes.NewReader(buffer.Bytes()))
 			}
 		},
+		nil,
 	)
-	err := b.Run(c.Workdir)
+	err := b.Run(context.Background(), c.Workdir)
 	if err != nil {
 		t.Fatalf("failed to run: %s", err)
 	}
@@ -84,6 +88,7 @@ build php-custom -f php-custom/Dockerfile --build-arg VERSION=8.3 --build-arg SP
 build php-custom -f php-custom/Dockerfile --build-arg VERSION=8.3 -t localhost:5000/images/php-custom:8.3 -t localhost:5000/images/php-custom:8.3-7
 build php-custom -f php-custom/Dockerfile --build-arg VERSION=8.4 -t localhost:5000/images/php-custom:8.4 -t localhost:5000/images/php-custom:8.4-7
 build php-custom -f php-custom/Dockerfile -t localhost:5000/images/php-custom:latest -t localhost:5000/images/php-custom:7
+build alpine -f alpine/Dockerfile -t localhost:5000/images/shared:latest -t localhost:5000/images/shared:7
 build python -f python/Dockerfile --build-arg VERSION=2.7 --build-arg OS=alpine -t localhost:5000/images/python:2.7-alpine -t localhost:5000/images/python:2.7-alpine-7
 build python -f python/Dockerfile --build-arg VERSION=2.7 --build-arg OS=stretch -t localhost:5000/images/python:2.7-stretch -t localhost:5000/images/python:2.7-stretch-7
 build python -f python/Dockerfile --build-arg VERSION=3.6 --build-arg OS=alpine -t localhost:5000/images/python:latest -t localhost:5000/images/python:3.6-alpine -t localhost:5000/images/python:3.6-alpine-7
@@ -164,6 +169,8 @@ push localhost:5000/images/python:3.6-stretch-7
 push localhost:5000/images/python:latest
 push localhost:5000/images/remote:7
 push localhost:5000/images/remote:latest
+push localhost:5000/images/shared:7
+push localhost:5000/images/shared:latest
 push localhost:5000/images/velero:aws-v1.0.0
 push localhost:5000/images/velero:aws-v1.0.0-7
 push localhost:5000/images/velero:aws-v1.1.0
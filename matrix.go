@@ -53,8 +53,58 @@ type (
 		// CustomPath allowes to overwrite the path of the docker context
 		CustomPath string `yaml:"custom_path"`
 
+		// Context is a local docker context relative to the image
+		// directory, it overwrites CustomPath:
+		//
+		//   context: ..
+		Context string `yaml:"context"`
+
 		// CustomDockerfile allowes to specify a custom Dockerfile
 		CustomDockerfile string `yaml:"custom_dockerfile" default:"Dockerfile"`
+
+		// SensitiveArgs lists build arguments whose values are masked in
+		// all output
+		//
+		//   sensitive_args:
+		//     - NPM_TOKEN
+		SensitiveArgs []string `yaml:"sensitive_args"`
+
+		// WatchPaths are patterns, relative to the working directory, of
+		// files that change the image in diff mode, i.e. shared files
+		// outside of the build context:
+		//
+		//   watch_paths:
+		//     - common/**/*.sh
+		WatchPaths []string `yaml:"watch_paths"`
+
+		// FloatingTags adds alias tags for the newest versions of a
+		// dimension, see FloatingTags
+		FloatingTags *FloatingTags `yaml:"floating_tags"`
+
+		// TagPolicy overwrites the tag templates of the global tag policy
+		//
+		//   tag_policy:
+		//     branch: ["{{.Tag}}-{{.BranchSlug}}"]
+		TagPolicy *TagPolicy `yaml:"tag_policy"`
+
+		// Labels are added to each image, the values are templates with
+		// access to LabelData:
+		//
+		//   labels:
+		//     org.example.php-version: "{{.Args.VERSION}}"
+		Labels map[string]string `yaml:"labels"`
+
+		// Annotations are added to the manifest of each image, like
+		// Labels. They require buildx.
+		Annotations map[string]string `yaml:"annotations"`
+
+		// Timeout overwrites the BUILD_TIMEOUT for each build and upload
+		// of the image, i.e. `45m`
+		Timeout string `yaml:"timeout"`
+
+		// Priority moves the builds of the image ahead in the build queue,
+		// higher priorities start first (default: 0)
+		Priority int `yaml:"priority"`
 	}
 )
 
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// metricsPrefix is the prefix of all metric names
+	metricsPrefix = "drone_docker_matrix"
+
+	// pushAttempts is the number of attempts to push to the pushgateway
+	pushAttempts = 3
+)
+
+var (
+	// durationBuckets are the histogram buckets of durations in seconds
+	durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+	// pushBackoff is the delay of the first retry of a push, it doubles with
+	// each attempt
+	pushBackoff = time.Second
+)
+
+type (
+	// metricFamily is a metric in the prometheus text format
+	metricFamily struct {
+		name    string
+		help    string
+		kind    string
+		samples []string
+		// series are the label sets already added, the text format does
+		// not allow duplicate series
+		series map[string]bool
+	}
+
+	// metricSet renders metric families, samples of the same metric are
+	// grouped as required by the text format
+	metricSet struct {
+		// labels are added to all samples
+		labels   []string
+		families []*metricFamily
+	}
+)
+
+// family returns the metric family, it is created on first use
+func (m *metricSet) family(name, kind, help string) *metricFamily {
+	for _, family := range m.families {
+		if family.name == name {
+			return family
+		}
+	}
+	family := &metricFamily{name: name, kind: kind, help: help, series: map[string]bool{}}
+	m.families = append(m.families, family)
+	return family
+}
+
+// add adds a sample of the series, later samples of the same series are
+// ignored
+func (f *metricFamily) add(series string, value float64) {
+	if f.series[series] {
+		return
+	}
+	f.series[series] = true
+	f.samples = append(f.samples, fmt.Sprintf("%s %s", series, strconv.FormatFloat(value, 'f', -1, 64)))
+}
+
+// series formats the name and labels of a sample, labels are key value pairs
+func (m *metricSet) series(name string, labels ...string) string {
+	labels = append(append([]string{}, m.labels...), labels...)
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+// gauge adds a gauge sample
+func (m *metricSet) gauge(name, help string, value float64, labels ...string) {
+	m.family(name, "gauge", help).add(m.series(name, labels...), value)
+}
+
+// histogram adds a histogram of the observations
+func (m *metricSet) histogram(name, help string, observations []float64, labels ...string) {
+	family := m.family(name, "histogram", help)
+	labels = labels[:len(labels):len(labels)]
+	sum := 0.0
+	for _, observation := range observations {
+		sum += observation
+	}
+	for _, bucket := range durationBuckets {
+		count := 0
+		for _, observation := range observations {
+			if observation <= bucket {
+				count++
+			}
+		}
+		le := strconv.FormatFloat(bucket, 'f', -1, 64)
+		family.add(m.series(name+"_bucket", append(labels, "le", le)...), float64(count))
+	}
+	family.add(m.series(name+"_bucket", append(labels, "le", "+Inf")...), float64(len(observations)))
+	family.add(m.series(name+"_sum", labels...), sum)
+	family.add(m.series(name+"_count", labels...), float64(len(observations)))
+}
+
+// String renders the metrics in the prometheus text format
+func (m *metricSet) String() string {
+	buffer := &strings.Builder{}
+	for _, family := range m.families {
+		fmt.Fprintf(buffer, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			fmt.Fprintln(buffer, sample)
+		}
+	}
+	return buffer.String()
+}
+
+// addBuilds adds the metrics of the builds of an image
+func (m *metricSet) addBuilds(builds []*DockerBuild) {
+	durations := map[string][]float64{}
+	waits := map[string][]float64{}
+	for _, b := range builds {
+		status := b.status()
+		for _, s := range []string{statusSucceeded, statusFailed, statusSkipped, statusCanceled} {
+			value := 0.0
+			if s == status {
+				value = 1
+			}
+			m.gauge(metricsPrefix+"_build_status", "Status of the last build per tag", value, "tag", b.Tag, "status", s)
+		}
+		if status == statusSucceeded {
+			for _, tag := range b.tags() {
+				m.gauge(metricsPrefix, "Time of the last successful build per pushed tag", float64(c.Time.Unix()), "tag", tag)
+			}
+		}
+		if b.Size > 0 {
+			m.gauge(metricsPrefix+"_image_size_bytes", "Uncompressed size of the image", float64(b.Size), "tag", b.Tag)
+		}
+		for _, stage := range sortedKeys(b.Attempts) {
+			m.gauge(metricsPrefix+"_retries", "Number of retries per stage", float64(b.Attempts[stage]-1), "tag", b.Tag, "stage", stage)
+		}
+		for stage, duration := range b.Durations {
+			durations[stage] = append(durations[stage], duration.Seconds())
+		}
+		for stage, wait := range b.Waits {
+			waits[stage] = append(waits[stage], wait.Seconds())
+		}
+	}
+	for _, stage := range sortedKeys(durations) {
+		m.histogram(metricsPrefix+"_stage_duration_seconds", "Duration of the build and upload stages", durations[stage], "stage", stage)
+	}
+	for _, stage := range sortedKeys(waits) {
+		m.histogram(metricsPrefix+"_queue_wait_seconds", "Time waited for a free slot of the pool", waits[stage], "stage", stage)
+	}
+	m.gauge(metricsPrefix+"_last_run_timestamp_seconds", "Time of the last run", float64(c.Time.Unix()))
+}
+
+// sortedKeys returns the keys of the map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// imageGroups groups the builds by namespace and image
+func (f *Finisher) imageGroups() (keys [][2]string, groups map[[2]string][]*DockerBuild) {
+	groups = map[[2]string][]*DockerBuild{}
+	for _, b := range f.sortedResults() {
+		key := [2]string{b.Namespace, b.Name}
+		if _, found := groups[key]; !found {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], b)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys, groups
+}
+
+// groupingKey encodes a label of the pushgateway url, values with slashes
+// or empty values are base64 encoded
+func groupingKey(label, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Sprintf("%s@base64/%s", label, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+	return fmt.Sprintf("%s/%s", label, url.PathEscape(value))
+}
+
+// pushMetrics replaces the metrics of a group on the pushgateway, failed
+// requests and server errors are retried
+func pushMetrics(ctx context.Context, target string, content string) (err error) {
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		retryable, err = pushMetricsOnce(ctx, target, content)
+		if err == nil || !retryable || attempt >= pushAttempts {
+			return err
+		}
+		delay := pushBackoff * time.Duration(1<<(attempt-1))
+		log.Debugf("Retrying push of metrics to %s in %s: %s", target, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// pushMetricsOnce sends the metrics, the result reports if a failure is
+// worth a retry
+func pushMetricsOnce(ctx context.Context, target string, content string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, strings.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body := &bytes.Buffer{}
+		_, _ = body.ReadFrom(resp.Body)
+		err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(body.String()))
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+	}
+	return false, nil
+}
+
+// PushMetrics pushes the metrics of each image to the pushgateway, grouped
+// by job and image name as in earlier versions, the namespace is a label of
+// the samples. Images without builds in this run are not touched.
+func (f *Finisher) PushMetrics(ctx context.Context) error {
+	failed := 0
+	keys, groups := f.imageGroups()
+	var names []string
+	images := map[string]*metricSet{}
+	for _, key := range keys {
+		metrics, found := images[key[1]]
+		if !found {
+			metrics = &metricSet{}
+			images[key[1]] = metrics
+			names = append(names, key[1])
+		}
+		metrics.labels = []string{"namespace", key[0]}
+		metrics.addBuilds(groups[key])
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		target := fmt.Sprintf(
+			"%s/%s/%s",
+			strings.TrimSuffix(c.PushGateway, "/"),
+			groupingKey("job", c.PushGatewayJob),
+			groupingKey("image", name),
+		)
+		err := pushMetrics(ctx, target, images[name].String())
+		if err != nil {
+			log.Errorf("Unable to push metrics of %s: %s", name, secrets.Redact(err.Error()))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to push metrics of %d images", failed)
+	}
+	return nil
+}
+
+// WriteMetrics writes the metrics of all images in the textfile format of
+// the node exporter to path. The file is replaced atomically so that the
+// node exporter never reads a partial file.
+func (f *Finisher) WriteMetrics(path string) error {
+	metrics := &metricSet{}
+	keys, groups := f.imageGroups()
+	for _, key := range keys {
+		metrics.labels = []string{"job", c.PushGatewayJob, "namespace", key[0], "image", key[1]}
+		metrics.addBuilds(groups[key])
+	}
+
+	err := writeFileAtomic(path, []byte(metrics.String()))
+	if err != nil {
+		return fmt.Errorf("unable to write metrics file: %w", err)
+	}
+	return nil
+}
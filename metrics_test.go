@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setMetricsConfig configures the pushgateway job of the results
+func setMetricsConfig(t *testing.T) {
+	setResultConfig(t)
+	c.PushGatewayJob = "drone-docker-matrix"
+}
+
+func TestMetricSet(t *testing.T) {
+	oldBuckets := durationBuckets
+	defer func() { durationBuckets = oldBuckets }()
+	durationBuckets = []float64{1, 10}
+
+	metrics := &metricSet{labels: []string{"job", "test"}}
+	metrics.gauge("size", "Size of the image", 1024, "tag", "8.3")
+	metrics.histogram("duration", "Duration of the stage", []float64{0.5, 3, 20}, "stage", "build")
+	metrics.gauge("size", "Size of the image", 2048, "tag", "8.2")
+	metrics.gauge("size", "Size of the image", 4096, "tag", "8.3")
+
+	want := strings.Join([]string{
+		"# HELP size Size of the image",
+		"# TYPE size gauge",
+		`size{job="test",tag="8.3"} 1024`,
+		`size{job="test",tag="8.2"} 2048`,
+		"# HELP duration Duration of the stage",
+		"# TYPE duration histogram",
+		`duration_bucket{job="test",stage="build",le="1"} 1`,
+		`duration_bucket{job="test",stage="build",le="10"} 2`,
+		`duration_bucket{job="test",stage="build",le="+Inf"} 3`,
+		`duration_sum{job="test",stage="build"} 23.5`,
+		`duration_count{job="test",stage="build"} 3`,
+		"",
+	}, "\n")
+	if got := metrics.String(); got != want {
+		t.Errorf("want metrics\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestMetricsDuplicateTags(t *testing.T) {
+	setMetricsConfig(t)
+	b := resultBuild("images", "php", "8.3", nil)
+	b.AsLatest = "8.3"
+	b.AdditionalNames = []string{"mirror.example.com/php", "docker.io/example/php"}
+
+	// every additional name repeats the latest tag of the image
+	latest := "registry.example.com/images/php:latest"
+	if count := strings.Count(strings.Join(b.tags(), " "), latest); count < 2 {
+		t.Fatalf("expected duplicate latest tags, got %v", b.tags())
+	}
+	metrics := &metricSet{}
+	metrics.addBuilds([]*DockerBuild{b})
+	if count := strings.Count(metrics.String(), `tag="`+latest+`"`); count != 1 {
+		t.Errorf("want one sample of %s, got %d\n%s", latest, count, metrics.String())
+	}
+}
+
+func TestGroupingKey(t *testing.T) {
+	tests := map[[2]string]string{
+		{"job", "drone-docker-matrix"}: "job/drone-docker-matrix",
+		{"image", "php"}:               "image/php",
+		{"image", "php 8"}:             "image/php%208",
+		{"image", "org/php"}:           "image@base64/b3JnL3BocA",
+		{"image", ""}:                  "image@base64/",
+	}
+	for test, want := range tests {
+		if got := groupingKey(test[0], test[1]); got != want {
+			t.Errorf("%v: want %s, got %s", test, want, got)
+		}
+	}
+}
+
+func TestPushMetricsRetries(t *testing.T) {
+	oldBackoff := pushBackoff
+	defer func() { pushBackoff = oldBackoff }()
+	pushBackoff = time.Millisecond
+
+	tests := []struct {
+		statuses []int
+		requests int
+		fails    bool
+	}{
+		{[]int{http.StatusOK}, 1, false},
+		{[]int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}, 3, false},
+		{[]int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}, 3, true},
+		{[]int{http.StatusBadRequest, http.StatusOK}, 1, true},
+	}
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if r.Method != http.MethodPut || string(body) != "metric 1\n" {
+				t.Errorf("unexpected request %s %q", r.Method, body)
+			}
+			w.WriteHeader(test.statuses[requests])
+			requests++
+		}))
+		err := pushMetrics(context.Background(), server.URL+"/metrics/job/test", "metric 1\n")
+		server.Close()
+		if (err != nil) != test.fails {
+			t.Errorf("%v: unexpected result %v", test.statuses, err)
+		}
+		if requests != test.requests {
+			t.Errorf("%v: want %d requests, got %d", test.statuses, test.requests, requests)
+		}
+	}
+}
+
+func TestFinisherPushMetrics(t *testing.T) {
+	setMetricsConfig(t)
+	mutex := sync.Mutex{}
+	pushed := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		pushed[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+	c.PushGateway = server.URL + "/"
+
+	f := &Finisher{results: []*DockerBuild{
+		resultBuild("images", "php", "8.3", nil),
+		resultBuild("legacy", "php", "7.4", errors.New("build failed")),
+		resultBuild("images", "node", "22", nil),
+	}}
+	err := f.PushMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("unable to push metrics: %s", err)
+	}
+
+	// the grouping key of earlier versions, namespaces share the group
+	if len(pushed) != 2 || pushed["/job/drone-docker-matrix/image/node"] == "" {
+		t.Fatalf("unexpected groups %v", pushed)
+	}
+	php := pushed["/job/drone-docker-matrix/image/php"]
+	for _, sample := range []string{
+		`drone_docker_matrix{namespace="images",tag="registry.example.com/images/php:8.3"} 1714564800`,
+		`drone_docker_matrix_build_status{namespace="legacy",tag="7.4",status="failed"} 1`,
+		`drone_docker_matrix_retries{namespace="images",tag="8.3",stage="build"} 1`,
+		`drone_docker_matrix_stage_duration_seconds_bucket{namespace="images",stage="upload",le="30"} 1`,
+	} {
+		if !strings.Contains(php, sample+"\n") {
+			t.Errorf("missing sample %s in\n%s", sample, php)
+		}
+	}
+	if strings.Count(php, "# TYPE drone_docker_matrix_build_status ") != 1 {
+		t.Errorf("samples of a metric are not grouped\n%s", php)
+	}
+	if strings.Contains(php, "legacy/php:7.4") {
+		t.Errorf("failed build reported as pushed\n%s", php)
+	}
+}
+
+func TestFinisherWriteMetrics(t *testing.T) {
+	setMetricsConfig(t)
+	path := filepath.Join(t.TempDir(), "drone-docker-matrix.prom")
+	f := &Finisher{results: []*DockerBuild{
+		resultBuild("images", "php", "8.3", nil),
+		resultBuild("images", "node", "22", nil),
+	}}
+	err := f.WriteMetrics(path)
+	if err != nil {
+		t.Fatalf("unable to write metrics: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range []string{
+		`drone_docker_matrix_last_run_timestamp_seconds{job="drone-docker-matrix",namespace="images",image="node"} 1714564800`,
+		`drone_docker_matrix_last_run_timestamp_seconds{job="drone-docker-matrix",namespace="images",image="php"} 1714564800`,
+	} {
+		if !strings.Contains(string(content), sample+"\n") {
+			t.Errorf("missing sample %s in\n%s", sample, content)
+		}
+	}
+}
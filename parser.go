@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/drone/envsubst"
 	"github.com/segmentio/ksuid"
@@ -25,11 +27,9 @@ func (p *Parser) WaitAndClose() {
 	close(p.output)
 }
 
-// Parse loads a docker-matrix and creates builds to input
-func (p *Parser) Parse(name string) error {
-	p.wg.Add(1)
-	defer p.wg.Done()
-
+// Expand loads a docker-matrix and returns the builds without scheduling
+// them
+func (p *Parser) Expand(name string) ([]*DockerBuild, error) {
 	id := ksuid.New()
 	matrixFile := filepath.Join(name, "docker-matrix.yml")
 
@@ -37,7 +37,7 @@ func (p *Parser) Parse(name string) error {
 	if name == "." {
 		p, err := filepath.Abs(path)
 		if err != nil {
-			return fmt.Errorf("%s unable to get directory name.", id)
+			return nil, fmt.Errorf("%s unable to get directory name.", id)
 		}
 		name = filepath.Base(p)
 	}
@@ -49,7 +49,7 @@ func (p *Parser) Parse(name string) error {
 	if os.IsNotExist(err) {
 		return p.normalBuild(b)
 	} else if err != nil {
-		return fmt.Errorf("unable to stat matrixfile: %w", err)
+		return nil, fmt.Errorf("unable to stat matrixfile: %w", err)
 	}
 
 	// otherwise run matrix build
@@ -57,10 +57,40 @@ func (p *Parser) Parse(name string) error {
 
 }
 
-func (p *Parser) normalBuild(b *DockerBuild) error {
-	p.wg.Add(1)
-	defer p.wg.Done()
+// ExpandAll expands all images in path without scheduling them
+func (p *Parser) ExpandAll(path string) ([]*DockerBuild, error) {
+	oldPath, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get current workdir %w", err)
+	}
+	err = os.Chdir(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to change directory to %s: %w", path, err)
+	}
+	defer os.Chdir(oldPath)
+
+	builds := []*DockerBuild{}
+	err = filepath.Walk(".", func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filepath.Base(file) != "Dockerfile" {
+			return nil
+		}
+		expanded, err := p.Expand(filepath.Base(filepath.Dir(file)))
+		if err != nil {
+			return fmt.Errorf("unable to parse file: %w", err)
+		}
+		builds = append(builds, expanded...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk files: %w", err)
+	}
+	return builds, nil
+}
 
+func (p *Parser) normalBuild(b *DockerBuild) ([]*DockerBuild, error) {
 	tag := c.TagName
 	if tag == "" {
 		tag = "latest"
@@ -71,22 +101,20 @@ func (p *Parser) normalBuild(b *DockerBuild) error {
 	b.Tag = tag
 	b.Arguments = make(map[string]string)
 	b.AdditionalNames = []string{}
+	b.Timeout = c.BuildTimeout
 
-	p.output <- b
-	return nil
+	return []*DockerBuild{b}, nil
 }
 
-func (p *Parser) matrixBuild(b *DockerBuild, matrixFile string) error {
+func (p *Parser) matrixBuild(b *DockerBuild, matrixFile string) ([]*DockerBuild, error) {
 	var m Matrix
 	err := loadMatrix(matrixFile, b, &m)
 	if err != nil {
-		return fmt.Errorf("unable to load matrix file")
+		return nil, fmt.Errorf("unable to load matrix file")
 	}
 
 	// apply settings
-	if m.CustomPath != "" {
-		b.Path = m.CustomPath
-	}
+	b.Path = resolveContext(b.Path, &m)
 	if m.CustomDockerfile == "" {
 		m.CustomDockerfile = "Dockerfile"
 	}
@@ -97,6 +125,23 @@ func (p *Parser) matrixBuild(b *DockerBuild, matrixFile string) error {
 	if m.Namespace != "" {
 		namespace = m.Namespace
 	}
+	timeout := c.BuildTimeout
+	if m.Timeout != "" {
+		timeout, err = time.ParseDuration(m.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid timeout %q: %w", b.ID, m.Timeout, err)
+		}
+	}
+
+	var tagPolicy *TagPolicy
+	if m.TagPolicy != nil {
+		merged := c.TagPolicy.Merge(m.TagPolicy)
+		err = merged.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid tag_policy: %w", b.ID, err)
+		}
+		tagPolicy = &merged
+	}
 
 	// if possible add images to cleanup
 	froms, err := parseFromsFromDockerfile(m.CustomDockerfile)
@@ -120,6 +165,10 @@ func (p *Parser) matrixBuild(b *DockerBuild, matrixFile string) error {
 		AsLatest:        m.AsLatest,
 		Dockerfile:      m.CustomDockerfile,
 		Froms:           froms,
+		Timeout:         timeout,
+		Priority:        m.Priority,
+		TagPolicy:       tagPolicy,
+		SensitiveArgs:   m.SensitiveArgs,
 	}}
 
 	// handle multiply arguments
@@ -138,20 +187,62 @@ func (p *Parser) matrixBuild(b *DockerBuild, matrixFile string) error {
 
 	// add custom build
 	for _, customBuild := range m.CustomBuilds {
-		builds = append(builds, handleCustom(b, &m, froms, namespace, customBuild))
+		custom := handleCustom(b, &m, froms, namespace, customBuild)
+		custom.Timeout = timeout
+		custom.Priority = m.Priority
+		custom.TagPolicy = tagPolicy
+		custom.SensitiveArgs = m.SensitiveArgs
+		builds = append(builds, custom)
+	}
+
+	// mask sensitive arguments before anything is logged, the values of
+	// matrix arguments are part of the tag and would be pushed
+	for _, build := range builds {
+		for _, arg := range m.SensitiveArgs {
+			secrets.Add(build.Arguments[arg])
+			if build.Arguments[arg] != "" {
+				return nil, fmt.Errorf("%s sensitive argument %s of %s is part of the tag", b.ID, arg, b.Name)
+			}
+		}
 	}
 
-	// schedule building
 	for _, build := range builds {
 		if build.Tag == "" {
 			build.Tag = "latest"
 		}
-		p.wg.Add(1)
-		defer p.wg.Done()
-		p.output <- build
+		build.Labels, err = renderTemplates(m.Labels, build)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid label: %w", b.ID, err)
+		}
+		build.Annotations, err = renderTemplates(m.Annotations, build)
+		if err != nil {
+			return nil, fmt.Errorf("%s invalid annotation: %w", b.ID, err)
+		}
 	}
+	applyFloatingTags(builds, m.FloatingTags)
 
-	return nil
+	return builds, nil
+}
+
+// Schedule passes the build to the build stage unless ctx is canceled, it
+// returns false if the build was not scheduled
+func (p *Parser) Schedule(ctx context.Context, b *DockerBuild) bool {
+	p.wg.Add(1)
+	defer p.wg.Done()
+	if ctx.Err() != nil {
+		log.Warnf("%s not scheduling %s: %s", b.ID, b.prettyName(), context.Cause(ctx))
+		return false
+	}
+	_, b.span = tracer.Start(
+		ctx, b.prettyName(),
+		"image.namespace", b.Namespace,
+		"image.name", b.Name,
+		"image.tag", b.Tag,
+		"image.reason", b.Reason,
+	)
+	events.EmitBuild(eventPlanned, b, &Event{Reason: b.Reason})
+	p.output <- b
+	return true
 }
 
 func loadMatrix(file string, b *DockerBuild, m *Matrix) error {
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type (
+	// PathPatterns matches paths against patterns with the same semantics
+	// as a .dockerignore file
+	PathPatterns struct {
+		patterns []ignorePattern
+	}
+
+	ignorePattern struct {
+		regexp    *regexp.Regexp
+		exclusion bool
+	}
+)
+
+// LoadPathPatterns reads a .dockerignore file, a missing file matches
+// nothing
+func LoadPathPatterns(path string) (*PathPatterns, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &PathPatterns{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	return NewPathPatterns(lines)
+}
+
+// NewPathPatterns compiles .dockerignore lines, comments and empty lines are
+// skipped
+func NewPathPatterns(lines []string) (*PathPatterns, error) {
+	d := &PathPatterns{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exclusion := false
+		if strings.HasPrefix(line, "!") {
+			exclusion = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = filepath.ToSlash(filepath.Clean(line))
+		line = strings.TrimPrefix(line, "/")
+		if line == "" || line == "." {
+			continue
+		}
+		re, err := compileIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid .dockerignore pattern %q: %w", line, err)
+		}
+		d.patterns = append(d.patterns, ignorePattern{
+			regexp:    re,
+			exclusion: exclusion,
+		})
+	}
+	return d, nil
+}
+
+// Match checks if path, relative to the build context, matches. Like docker
+// a pattern matching any parent directory matches its content and the last
+// matching pattern wins, `!` patterns revert a match.
+func (d *PathPatterns) Match(path string) bool {
+	path = filepath.ToSlash(filepath.Clean(path))
+	parents := strings.Split(path, "/")
+	parents = parents[:len(parents)-1]
+
+	matched := false
+	for _, pattern := range d.patterns {
+		match := pattern.regexp.MatchString(path)
+		for i := 1; !match && i <= len(parents); i++ {
+			match = pattern.regexp.MatchString(strings.Join(parents[:i], "/"))
+		}
+		if match {
+			matched = !pattern.exclusion
+		}
+	}
+	return matched
+}
+
+// compileIgnorePattern converts a .dockerignore pattern to a regular
+// expression: `**` matches any number of directories, `*` and `?` do not
+// match `/`
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					expr.WriteString("(.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "^") || strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		// `**` matches any number of directories
+		{[]string{"**/tests"}, "tests", true},
+		{[]string{"**/tests"}, "tests/unit.php", true},
+		{[]string{"**/tests"}, "src/tests/unit/a.php", true},
+		{[]string{"**/tests"}, "testsuite/a.php", false},
+		{[]string{"**/*.log"}, "debug.log", true},
+		{[]string{"**/*.log"}, "var/log/debug.log", true},
+		{[]string{"docs/**/*.png"}, "docs/a.png", true},
+		{[]string{"docs/**/*.png"}, "docs/img/a.png", true},
+		{[]string{"**"}, "any/file", true},
+
+		// `*` and `?` do not match `/`
+		{[]string{"*.md"}, "CHANGELOG.md", true},
+		{[]string{"*.md"}, "docs/index.md", false},
+		{[]string{"a?c"}, "abc", true},
+		{[]string{"a?c"}, "a/c", false},
+		{[]string{"[a-c]x"}, "bx", true},
+		{[]string{"[a-c]x"}, "dx", false},
+		{[]string{"[!a-c]x"}, "dx", true},
+
+		// a matching parent directory matches its content
+		{[]string{"dir/*"}, "dir/a", true},
+		{[]string{"dir/*"}, "dir/sub/b", true},
+		{[]string{"dir/*"}, "dir", false},
+		{[]string{"dir/*"}, "other/dir/a", false},
+		{[]string{"vendor"}, "vendor/a/b/c.go", true},
+		{[]string{"vendor"}, "src/vendor/c.go", false},
+		{[]string{"a/b"}, "a/b/c/d/e", true},
+		{[]string{"b/c"}, "a/b/c/d", false},
+
+		// the last matching pattern wins
+		{[]string{"*.md", "!README.md"}, "README.md", false},
+		{[]string{"*.md", "!README.md"}, "CHANGELOG.md", true},
+		{[]string{"!README.md", "*.md"}, "README.md", true},
+		{[]string{"build", "!build/keep.txt"}, "build/keep.txt", false},
+		{[]string{"build", "!build/keep.txt"}, "build/other.txt", true},
+		{[]string{"**/tests", "!**/tests/fixtures"}, "src/tests/fixtures/a.json", false},
+
+		// comments, empty lines and leading slashes
+		{[]string{"# root.txt", "", "/root.txt"}, "root.txt", true},
+		{[]string{"# root.txt"}, "# root.txt", false},
+		{[]string{"./src/../tmp"}, "tmp/a", true},
+		{nil, "Dockerfile", false},
+	}
+	for _, test := range tests {
+		patterns, err := NewPathPatterns(test.patterns)
+		if err != nil {
+			t.Fatalf("%q: %s", test.patterns, err)
+		}
+		if got := patterns.Match(test.path); got != test.want {
+			t.Errorf("%q matching %s: want %t, got %t", test.patterns, test.path, test.want, got)
+		}
+	}
+}
+
+func TestLoadPathPatterns(t *testing.T) {
+	dir := t.TempDir()
+	patterns, err := LoadPathPatterns(filepath.Join(dir, ".dockerignore"))
+	if err != nil || patterns.Match("a") {
+		t.Fatalf("a missing file must match nothing: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("# tests\n**/tests\n!tests/keep\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, err = LoadPathPatterns(filepath.Join(dir, ".dockerignore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !patterns.Match("tests/unit.php") || patterns.Match("tests/keep") {
+		t.Errorf("unexpected matches of the loaded patterns")
+	}
+
+	_, err = NewPathPatterns([]string{"[a-"})
+	if err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
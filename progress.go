@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// progress modes, `auto` renders the live view on a terminal and prints
+// progress lines otherwise
+const (
+	progressAuto  = "auto"
+	progressPlain = "plain"
+	progressTTY   = "tty"
+	progressOff   = "off"
+)
+
+const (
+	// progressRedraw is the refresh interval of the live view
+	progressRedraw = time.Second
+	// progressDefaultInterval is used for invalid progress intervals
+	progressDefaultInterval = 30 * time.Second
+	// progressNames is the number of running builds in a progress line
+	progressNames = 3
+	// progressViewLines limits the running builds in the live view
+	progressViewLines = 15
+)
+
+type (
+	// progressBuild is a scheduled build that is not finished yet
+	progressBuild struct {
+		name string
+		// stage is the running stage, empty while waiting
+		stage      string
+		started    time.Time
+		stageStart time.Time
+		// pushed is set once a tag of the build was pushed
+		pushed bool
+	}
+
+	// Progress follows the events of the run and periodically reports the
+	// number of built, pushed and failed images with an ETA. The progress
+	// line doubles as keep-alive for CI systems that stop quiet builds.
+	Progress struct {
+		mu       sync.Mutex
+		out      io.Writer
+		live     bool
+		interval time.Duration
+		start    time.Time
+
+		total, built, pushed, failed, skipped, done int
+		builds                                      map[string]*progressBuild
+		// expected are the durations of the previous run, finished the
+		// durations of the builds of this run
+		expected map[string]time.Duration
+		finished []time.Duration
+
+		// lines is the height of the live view on the screen
+		lines    int
+		previous io.Writer
+		stop     chan bool
+		stopped  chan bool
+	}
+
+	// progressWriter clears the live view before log output and draws it
+	// again below
+	progressWriter struct {
+		p *Progress
+	}
+)
+
+// isTerminal checks if the file is a character device
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// NewProgress creates a progress reporter, nil if the mode is `off` or
+// empty. It observes the events it is subscribed to.
+func NewProgress(mode string, interval time.Duration) *Progress {
+	live := false
+	switch mode {
+	case progressAuto:
+		live = isTerminal(os.Stderr)
+	case progressTTY:
+		live = true
+	case progressPlain:
+	default:
+		return nil
+	}
+	if interval <= 0 {
+		interval = progressDefaultInterval
+	}
+	return &Progress{
+		out:      os.Stderr,
+		live:     live,
+		interval: interval,
+		start:    time.Now(),
+		builds:   map[string]*progressBuild{},
+		expected: map[string]time.Duration{},
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+}
+
+// previousDurations reads the total duration per `name:tag` from the result
+// file of a previous run, empty if there is none
+func previousDurations(path string) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	if path == "" {
+		return durations
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return durations
+	}
+	results := Results{}
+	err = json.Unmarshal(content, &results)
+	if err != nil {
+		log.Debugf("Unable to read previous durations from %s: %s", path, err)
+		return durations
+	}
+	for _, image := range results.Images {
+		if image.Status != statusSucceeded {
+			continue
+		}
+		total := 0.0
+		for _, seconds := range image.Durations {
+			total += seconds
+		}
+		name := fmt.Sprintf("%s:%s", image.Name, strings.TrimPrefix(image.Tag, "latest-"))
+		durations[name] = time.Duration(total * float64(time.Second))
+	}
+	return durations
+}
+
+// Start reports the progress in the background until Stop is called.
+// Expected durations per `name:tag` improve the ETA.
+func (p *Progress) Start(expected map[string]time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.start = time.Now()
+	p.expected = expected
+	p.mu.Unlock()
+	if p.live {
+		p.previous = log.StandardLogger().Out
+		log.SetOutput(&progressWriter{p: p})
+	}
+	go func() {
+		defer close(p.stopped)
+		interval := p.interval
+		if p.live {
+			interval = progressRedraw
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.report()
+			}
+		}
+	}()
+}
+
+// Stop ends the reporting and removes the live view
+func (p *Progress) Stop() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+	if p.live {
+		p.mu.Lock()
+		p.clear()
+		p.mu.Unlock()
+		log.SetOutput(p.previous)
+	}
+}
+
+// key identifies a build in the events
+func (e *Event) key() string {
+	return e.ID + "/" + e.Namespace + "/" + e.Name + ":" + e.Tag
+}
+
+// observe updates the counts from an event
+func (p *Progress) observe(e *Event) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	build := p.builds[e.key()]
+	switch e.Type {
+	case eventPlanned:
+		p.total++
+		p.builds[e.key()] = &progressBuild{
+			name: fmt.Sprintf("%s:%s", e.Name, strings.TrimPrefix(e.Tag, "latest-")),
+		}
+	case eventStarted:
+		if build == nil {
+			return
+		}
+		build.stage = e.Stage
+		build.stageStart = e.Time
+		if build.started.IsZero() {
+			build.started = e.Time
+		}
+	case eventFinished:
+		if build != nil {
+			build.stage = ""
+		}
+		// uploads without a pushed tag are skipped
+		if e.Status == statusSucceeded && e.Stage == "build" {
+			p.built++
+		} else if e.Status == statusSucceeded && e.Stage == "upload" && build != nil && build.pushed {
+			p.pushed++
+		}
+	case eventPushFinished:
+		if build != nil && e.Error == "" {
+			build.pushed = true
+		}
+	case eventSucceeded, eventFailed, eventSkipped:
+		if build == nil {
+			return
+		}
+		delete(p.builds, e.key())
+		p.done++
+		switch e.Type {
+		case eventSucceeded:
+			p.finished = append(p.finished, time.Duration(e.Duration*float64(time.Second)))
+		case eventFailed:
+			p.failed++
+		case eventSkipped:
+			p.skipped++
+		}
+	}
+}
+
+// running returns the running builds, longest running first
+func (p *Progress) running() []*progressBuild {
+	running := []*progressBuild{}
+	for _, build := range p.builds {
+		if build.stage != "" {
+			running = append(running, build)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		if !running[i].stageStart.Equal(running[j].stageStart) {
+			return running[i].stageStart.Before(running[j].stageStart)
+		}
+		return running[i].name < running[j].name
+	})
+	return running
+}
+
+// eta estimates the remaining time from the expected duration of each
+// unfinished build and the number of builds running in parallel. The
+// expected duration is taken from the previous run or the average of this
+// run.
+func (p *Progress) eta(now time.Time) (time.Duration, bool) {
+	var average time.Duration
+	for _, duration := range p.finished {
+		average += duration
+	}
+	if len(p.finished) > 0 {
+		average /= time.Duration(len(p.finished))
+	}
+
+	var work time.Duration
+	for _, build := range p.builds {
+		expected, found := p.expected[build.name]
+		if !found {
+			expected = average
+		}
+		if expected == 0 {
+			return 0, false
+		}
+		if !build.started.IsZero() {
+			expected -= now.Sub(build.started)
+		}
+		if expected > 0 {
+			work += expected
+		}
+	}
+	parallel := len(p.running())
+	if parallel == 0 {
+		parallel = 1
+	}
+	return work / time.Duration(parallel), len(p.builds) > 0
+}
+
+// line formats the progress, i.e.
+// `42/200 built, 30/200 pushed, 3 failed, 8 running (php:8.3-alpine 4m12s, …)`
+func (p *Progress) line(now time.Time) string {
+	line := fmt.Sprintf("%d/%d built, %d/%d pushed, %d failed", p.built, p.total, p.pushed, p.total, p.failed)
+	if p.skipped > 0 {
+		line += fmt.Sprintf(", %d skipped", p.skipped)
+	}
+	running := p.running()
+	line += fmt.Sprintf(", %d running", len(running))
+	if len(running) > 0 {
+		names := []string{}
+		for i, build := range running {
+			if i == progressNames {
+				names = append(names, "…")
+				break
+			}
+			names = append(names, fmt.Sprintf("%s %s", build.name, now.Sub(build.stageStart).Round(time.Second)))
+		}
+		line += fmt.Sprintf(" (%s)", strings.Join(names, ", "))
+	}
+	if eta, ok := p.eta(now); ok {
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return line
+}
+
+// view renders the live view, the progress line and a line per running
+// build
+func (p *Progress) view(now time.Time) []string {
+	view := []string{fmt.Sprintf("Progress       %s, %s elapsed", p.line(now), now.Sub(p.start).Round(time.Second))}
+	running := p.running()
+	for i, build := range running {
+		if i == progressViewLines {
+			view = append(view, fmt.Sprintf("  … %d more", len(running)-i))
+			break
+		}
+		view = append(view, fmt.Sprintf("  %-7s %s %s", build.stage, build.name, now.Sub(build.stageStart).Round(time.Second)))
+	}
+	return view
+}
+
+// clear removes the live view from the screen, the lock must be held
+func (p *Progress) clear() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+		p.lines = 0
+	}
+}
+
+// draw renders the live view below the log output, the lock must be held
+func (p *Progress) draw() {
+	view := p.view(time.Now())
+	fmt.Fprintln(p.out, strings.Join(view, "\n"))
+	p.lines = len(view)
+}
+
+// report prints the progress line or redraws the live view
+func (p *Progress) report() {
+	p.mu.Lock()
+	if p.live {
+		p.clear()
+		p.draw()
+		p.mu.Unlock()
+		return
+	}
+	line := p.line(time.Now())
+	p.mu.Unlock()
+	log.Infof("Progress       %s", line)
+}
+
+// Write writes log output above the live view
+func (w *progressWriter) Write(content []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+	w.p.clear()
+	n, err := w.p.previous.Write(content)
+	w.p.draw()
+	return n, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// progressEvents emits the events of a build through the stream
+type progressEvents struct {
+	stream *EventStream
+	now    time.Time
+}
+
+// emit emits an event of the build at the offset of the run
+func (e *progressEvents) emit(eventType string, b *DockerBuild, offset time.Duration, event Event) {
+	event.Time = e.now.Add(offset)
+	e.stream.EmitBuild(eventType, b, &event)
+}
+
+func TestProgress(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p := NewProgress(progressPlain, time.Minute)
+	p.expected = map[string]time.Duration{"php:8.3": 10 * time.Minute}
+	stream, err := NewEventStream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Subscribe(p.observe)
+	e := &progressEvents{stream: stream, now: now}
+
+	builds := []*DockerBuild{}
+	for _, name := range []string{"php:8.3", "php:8.2", "node:22", "go:1.23", "rust:1"} {
+		b := &DockerBuild{ID: ksuid.New(), Namespace: "images"}
+		b.Name, b.Tag, _ = strings.Cut(name, ":")
+		builds = append(builds, b)
+		e.emit(eventPlanned, b, 0, Event{})
+	}
+	php, php82, node, golang, rust := builds[0], builds[1], builds[2], builds[3], builds[4]
+
+	// node is built and pushed, php:8.2 built without a push
+	for _, b := range []*DockerBuild{node, php82} {
+		e.emit(eventStarted, b, 0, Event{Stage: "build"})
+		e.emit(eventFinished, b, 2*time.Minute, Event{Stage: "build", Status: statusSucceeded})
+		e.emit(eventStarted, b, 2*time.Minute, Event{Stage: "upload"})
+	}
+	e.emit(eventPushFinished, node, 3*time.Minute, Event{Target: "registry.example.com/images/node:22"})
+	for _, b := range []*DockerBuild{node, php82} {
+		e.emit(eventFinished, b, 4*time.Minute, Event{Stage: "upload", Status: statusSucceeded})
+		e.emit(eventSucceeded, b, 4*time.Minute, Event{Duration: (4 * time.Minute).Seconds()})
+	}
+	// go failed, rust was skipped and php is running
+	e.emit(eventStarted, golang, time.Minute, Event{Stage: "build"})
+	e.emit(eventFinished, golang, 2*time.Minute, Event{Stage: "build", Status: statusFailed})
+	e.emit(eventFailed, golang, 2*time.Minute, Event{})
+	e.emit(eventSkipped, rust, 2*time.Minute, Event{})
+	e.emit(eventStarted, php, 3*time.Minute, Event{Stage: "build"})
+
+	if p.total != 5 || p.built != 2 || p.pushed != 1 || p.failed != 1 || p.skipped != 1 || p.done != 4 {
+		t.Errorf("unexpected counts %+v", p)
+	}
+
+	// php is expected to take 7 more minutes
+	at := now.Add(5 * time.Minute)
+	if eta, ok := p.eta(at); !ok || eta != 8*time.Minute {
+		t.Errorf("want an ETA of 8m, got %s %v", eta, ok)
+	}
+	want := "2/5 built, 1/5 pushed, 1 failed, 1 skipped, 1 running (php:8.3 2m0s), ETA 8m0s"
+	if got := p.line(at); got != want {
+		t.Errorf("want line\n%s\ngot\n%s", want, got)
+	}
+
+	// without expected duration the average of finished builds is used
+	p.expected = map[string]time.Duration{}
+	if eta, ok := p.eta(at); !ok || eta != 2*time.Minute {
+		t.Errorf("want an ETA of 2m, got %s %v", eta, ok)
+	}
+	e.emit(eventFinished, php, 6*time.Minute, Event{Stage: "build", Status: statusSucceeded})
+	e.emit(eventSucceeded, php, 6*time.Minute, Event{})
+	if _, ok := p.eta(at); ok {
+		t.Errorf("unexpected ETA without remaining builds")
+	}
+	want = "3/5 built, 1/5 pushed, 1 failed, 1 skipped, 0 running"
+	if got := p.line(at); got != want {
+		t.Errorf("want line\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestProgressModes(t *testing.T) {
+	if p := NewProgress(progressOff, 0); p != nil {
+		t.Errorf("expected no progress when disabled")
+	}
+	if p := NewProgress(progressTTY, 0); p == nil || !p.live || p.interval != progressDefaultInterval {
+		t.Errorf("unexpected live progress %+v", p)
+	}
+
+	// a disabled progress ignores all calls
+	var disabled *Progress
+	disabled.Start(nil)
+	disabled.observe(&Event{Type: eventPlanned})
+	disabled.Stop()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// modeBuild builds and uploads changed images
+	modeBuild = "build"
+	// modePromote copies the images of a previous build to their tags
+	modePromote = "promote"
+)
+
+type (
+	// Promotion copies the image of a previous build to all tags of the
+	// image
+	Promotion struct {
+		Build        *DockerBuild
+		Source       string
+		Destinations []string
+	}
+)
+
+// sourceTag returns the tag a build of the tag policy event pushed for the
+// build id
+func (b *DockerBuild) sourceTag(buildID, event string) (string, error) {
+	tags := b.tagPolicy().Apply(event, b.Tag)
+	if len(tags) == 0 {
+		return "", fmt.Errorf("no tags for %s", b.prettyName())
+	}
+	tag := strings.TrimPrefix(fmt.Sprintf("%s-%s", tags[0], buildID), "-")
+	tag = strings.TrimPrefix(tag, "latest-")
+	return fmt.Sprintf("%s/%s/%s:%s", c.Registry, b.Namespace, b.Name, tag), nil
+}
+
+// selectedForPromotion checks if the build matches PROMOTE_IMAGES, either
+// by name or by `name:tag`
+func selectedForPromotion(b *DockerBuild) bool {
+	if len(c.PromoteImages) == 0 {
+		return true
+	}
+	for _, image := range c.PromoteImages {
+		if image == b.Name || image == b.prettyName() || image == fmt.Sprintf("%s:%s", b.Name, b.Tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Promotions expands all images in path like the builder does and returns
+// the promotions from the build id to the tags without build id. The tags
+// are those of PromoteEvent, the event of the promotion itself is a
+// `promote` on an arbitrary branch.
+func Promotions(path, buildID string) ([]*Promotion, error) {
+	if buildID == "" {
+		return nil, errors.New("no build id to promote from")
+	}
+	server := c.Registry
+	if c.PromoteRegistry != "" {
+		server = c.PromoteRegistry
+	}
+
+	builds, err := (&Parser{}).ExpandAll(path)
+	if err != nil {
+		return nil, err
+	}
+	promotions := []*Promotion{}
+	for _, b := range builds {
+		if !selectedForPromotion(b) {
+			continue
+		}
+		source, err := b.sourceTag(buildID, c.PromoteEvent)
+		if err != nil {
+			return nil, err
+		}
+		destinations := []string{}
+		for _, tag := range b.tagsFor(server, "", c.PromoteEvent) {
+			if tag != source {
+				destinations = append(destinations, tag)
+			}
+		}
+		promotions = append(promotions, &Promotion{
+			Build:        b,
+			Source:       source,
+			Destinations: destinations,
+		})
+	}
+	return promotions, nil
+}
+
+// Promote copies the images of PROMOTE_FROM to their tags. All sources are
+// checked before anything is changed, so promoting an older build id rolls
+// the tags back to that build.
+func Promote(ctx context.Context, path string) error {
+	promotions, err := Promotions(path, c.PromoteFrom)
+	if err != nil {
+		return err
+	}
+	if len(promotions) == 0 {
+		log.Warnf("No images to promote")
+		return nil
+	}
+
+	missing := []string{}
+	for _, p := range promotions {
+		ref, err := ParseReference(p.Source)
+		if err != nil {
+			return err
+		}
+		exists, err := registry.Exists(ctx, ref)
+		if err != nil {
+			log.Warnf("Unable to check %s, trying anyway: %s", p.Source, err)
+			continue
+		}
+		if !exists {
+			missing = append(missing, p.Source)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("unable to promote, missing images: %s", strings.Join(missing, ", "))
+	}
+
+	failed := 0
+	for _, p := range promotions {
+		if ctx.Err() != nil {
+			return fmt.Errorf("promotion canceled: %w", context.Cause(ctx))
+		}
+		err := p.Run(ctx)
+		if err != nil {
+			failed++
+			log.Errorf("Promote failed %s, %s\n%s\n", p.Build.prettyName(), err, indent(string(p.Build.Output), "  "))
+			continue
+		}
+		log.Infof("Done           %s", p.Build.prettyName())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d promotions failed", failed, len(promotions))
+	}
+	return nil
+}
+
+// Run copies the source to all destinations, via the registry api if
+// enabled and possible, otherwise via pull, tag and push
+func (p *Promotion) Run(ctx context.Context) error {
+	source, err := ParseReference(p.Source)
+	if err != nil {
+		return err
+	}
+	pulled := false
+	for _, destination := range p.Destinations {
+		ref, err := ParseReference(destination)
+		if err != nil {
+			return err
+		}
+		if previous, err := registry.Manifest(ctx, ref); err == nil {
+			log.Infof("Replacing      %s (%s)", destination, previous.Digest)
+		}
+		if c.DryRun {
+			log.Warnf("Would promote  %s to %s", p.Source, destination)
+			continue
+		}
+
+		log.Warnf("Promoting      %s to %s", p.Source, destination)
+		if c.RegistryAPI && source.Host == ref.Host {
+			err = registry.Copy(ctx, source, ref)
+			if err == nil {
+				continue
+			}
+			log.Warnf("%s unable to promote %s via registry api, pushing instead: %s", p.Build.ID, destination, err)
+		}
+		if !pulled {
+			err = p.docker(ctx, "pull", p.Source)
+			if err != nil {
+				return err
+			}
+			pulled = true
+		}
+		err = p.docker(ctx, "tag", p.Source, destination)
+		if err != nil {
+			return err
+		}
+		err = p.Build.push(ctx, destination)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docker runs a docker command and records the output
+func (p *Promotion) docker(ctx context.Context, args ...string) error {
+	cmd := command(ctx, args...)
+	out, err := cmd.CombinedOutput()
+	p.Build.Output = append(p.Build.Output, secrets.RedactBytes(out)...)
+	return err
+}
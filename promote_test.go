@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPromotions(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"php/Dockerfile": "FROM alpine\n",
+		"php/docker-matrix.yml": "multiply:\n" +
+			"  VERSION: [\"8.3\"]\n" +
+			"as_latest: \"8.3\"\n",
+	})
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{
+		Registry:         "registry.example.com",
+		DefaultNamespace: "images",
+		TagName:          "latest",
+		TagPolicy:        defaultTagPolicy(t),
+	}
+
+	// promotions run on their own event, on any branch
+	setDroneEnv(t, map[string]string{
+		"DRONE_BUILD_EVENT": "promote",
+		"DRONE_BRANCH":      "feature/x",
+		"DRONE_REPO_BRANCH": "main",
+		"DRONE_TAG":         "v1.2.0",
+	})
+	tests := []struct {
+		event, registry string
+		source          string
+		destinations    []string
+	}{
+		{
+			eventDefault, "",
+			"registry.example.com/images/php:8.3-b7",
+			[]string{"registry.example.com/images/php:latest", "registry.example.com/images/php:8.3"},
+		},
+		{
+			eventTag, "",
+			"registry.example.com/images/php:8.3-b7",
+			[]string{"registry.example.com/images/php:latest", "registry.example.com/images/php:8.3", "registry.example.com/images/php:8.3-1.2.0"},
+		},
+		{
+			eventBranch, "mirror.example.com",
+			"registry.example.com/images/php:8.3-b7",
+			[]string{"mirror.example.com/images/php:8.3"},
+		},
+	}
+	for _, test := range tests {
+		c.PromoteEvent = test.event
+		c.PromoteRegistry = test.registry
+		promotions, err := Promotions(dir, "b7")
+		if err != nil {
+			t.Fatalf("%s: %s", test.event, err)
+		}
+		if len(promotions) != 1 {
+			t.Fatalf("%s: want one promotion, got %d", test.event, len(promotions))
+		}
+		if promotions[0].Source != test.source {
+			t.Errorf("%s: want source %s, got %s", test.event, test.source, promotions[0].Source)
+		}
+		if !reflect.DeepEqual(promotions[0].Destinations, test.destinations) {
+			t.Errorf("%s: want destinations %v, got %v", test.event, test.destinations, promotions[0].Destinations)
+		}
+	}
+
+	_, err := Promotions(dir, "")
+	if err == nil {
+		t.Errorf("expected an error without build id")
+	}
+	c.PromoteImages = []string{"node"}
+	promotions, err := Promotions(dir, "b7")
+	if err != nil || len(promotions) != 0 {
+		t.Errorf("expected no promotions of other images, got %d %v", len(promotions), err)
+	}
+}
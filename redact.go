@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// redactMask replaces every secret in the output
+	redactMask = "********"
+	// redactMinLength is the minimal length of a secret, shorter values
+	// would mask too much of the regular output
+	redactMinLength = 4
+)
+
+// secretEnvSuffixes are environment variable name suffixes that are
+// treated as secret without being configured explicitly
+var secretEnvSuffixes = []string{"_PASSWORD", "_TOKEN", "_SECRET"}
+
+type (
+	// Redactor masks registered secrets in log lines and build output
+	Redactor struct {
+		mu      sync.RWMutex
+		secrets []string
+	}
+
+	// redactFormatter wraps a logrus formatter and redacts the formatted
+	// entry
+	redactFormatter struct {
+		log.Formatter
+		redactor *Redactor
+	}
+
+	// redactWriter masks the secrets of each write, the writes must contain
+	// complete lines
+	redactWriter struct {
+		io.Writer
+		redactor *Redactor
+	}
+)
+
+// secrets is the central redactor used by all log output and build output
+var secrets = &Redactor{}
+
+// Add registers a secret value. Multi-line values are additionally
+// registered line by line, since tools tend to reformat them.
+func (r *Redactor) Add(secret string) {
+	values := []string{secret}
+	if strings.Contains(secret, "\n") {
+		values = append(values, strings.Split(secret, "\n")...)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < redactMinLength || r.contains(value) {
+			continue
+		}
+		r.secrets = append(r.secrets, value)
+	}
+
+	// longest first, so a secret containing another one is masked as a
+	// whole
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+// AddEnv registers the values of the named environment variables and of all
+// variables ending with one of secretEnvSuffixes
+func (r *Redactor) AddEnv(names []string) {
+	for _, name := range names {
+		r.Add(os.Getenv(name))
+	}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		for _, suffix := range secretEnvSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				r.Add(value)
+			}
+		}
+	}
+}
+
+// configSecrets returns the secret values of the configuration, values
+// from environment variables with a secret suffix are added by AddEnv
+func configSecrets(cfg config) []string {
+	values := []string{cfg.Password, cfg.DockerConfigJSON, cfg.HistoryToken}
+	for _, header := range cfg.TraceHeaders {
+		_, value, _ := strings.Cut(header, "=")
+		values = append(values, value)
+	}
+	return values
+}
+
+// Redact masks all secrets in text
+func (r *Redactor) Redact(text string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redactMask)
+	}
+	return text
+}
+
+// RedactBytes masks all secrets in output
+func (r *Redactor) RedactBytes(output []byte) []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		output = bytes.ReplaceAll(output, []byte(secret), []byte(redactMask))
+	}
+	return output
+}
+
+// contains checks if the secret is already registered, requires the lock
+func (r *Redactor) contains(secret string) bool {
+	for _, s := range r.secrets {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// Format formats the entry with the wrapped formatter and masks the secrets
+func (f *redactFormatter) Format(entry *log.Entry) ([]byte, error) {
+	formatted, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return f.redactor.RedactBytes(formatted), nil
+}
+
+// Writer wraps w, the secrets are masked in everything written to it
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &redactWriter{Writer: w, redactor: r}
+}
+
+// Write masks the secrets and writes the content
+func (w *redactWriter) Write(content []byte) (int, error) {
+	_, err := w.Writer.Write(w.redactor.RedactBytes(content))
+	if err != nil {
+		return 0, err
+	}
+	return len(content), nil
+}
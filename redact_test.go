@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRedactor(t *testing.T) {
+	r := &Redactor{}
+	r.Add("abcd")
+	r.Add("abcdefgh")
+	r.Add("abcd")
+	r.Add("abc")
+	r.Add("")
+
+	// the longer secret is masked as a whole, not as its prefix
+	got := r.Redact("x abcdefgh y abcd z abc")
+	if want := "x ******** y ******** z abc"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if len(r.secrets) != 2 {
+		t.Errorf("duplicate or short secrets registered: %d", len(r.secrets))
+	}
+
+	// multi-line secrets are masked as a whole and line by line
+	r.Add("-----BEGIN KEY-----\nfirst-line\n  second-line\n-----END KEY-----")
+	output := []byte("key:\n-----BEGIN KEY-----\nfirst-line\n  second-line\n-----END KEY-----\nreformatted: second-line")
+	want := "key:\n********\nreformatted: ********"
+	if got := string(r.RedactBytes(output)); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if got := r.Redact("first-line"); got != redactMask {
+		t.Errorf("single line of a secret not masked: %q", got)
+	}
+}
+
+func TestRedactorAddEnv(t *testing.T) {
+	t.Setenv("PLUGIN_LOGIN_DOCKER_IO_PASSWORD", "registry-password")
+	t.Setenv("NPM_TOKEN", "npm-token-value")
+	t.Setenv("API_SECRET", "api-secret-value")
+	t.Setenv("CUSTOM_CREDENTIAL", "custom-value")
+	t.Setenv("PLAIN_VALUE", "plain-value")
+
+	r := &Redactor{}
+	r.AddEnv([]string{"CUSTOM_CREDENTIAL", "UNSET_VARIABLE"})
+	got := r.Redact("registry-password npm-token-value api-secret-value custom-value plain-value")
+	if want := "******** ******** ******** ******** plain-value"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestConfigSecrets(t *testing.T) {
+	cfg := config{
+		Password:         "registry-password",
+		DockerConfigJSON: `{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`,
+		HistoryToken:     "history-token",
+		TraceHeaders:     []string{"Authorization=Bearer trace-token", "X-Empty"},
+	}
+	r := &Redactor{}
+	for _, secret := range configSecrets(cfg) {
+		r.Add(secret)
+	}
+	got := r.Redact("registry-password " + cfg.DockerConfigJSON + " history-token Bearer trace-token X-Empty")
+	if want := "******** ******** ******** ******** X-Empty"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRedactFormatter(t *testing.T) {
+	r := &Redactor{}
+	r.Add("hunter22")
+	r.Add("token-value")
+	out := &bytes.Buffer{}
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = &redactFormatter{
+		Formatter: &log.TextFormatter{DisableColors: true, DisableTimestamp: true},
+		redactor:  r,
+	}
+
+	logger.WithField("password", "hunter22").Infof("using token-value for %s", "registry.example.com")
+	got := out.String()
+	if strings.Contains(got, "hunter22") || strings.Contains(got, "token-value") {
+		t.Errorf("secret in log output: %s", got)
+	}
+	if !strings.Contains(got, "password=********") || !strings.Contains(got, `msg="using ******** for registry.example.com"`) {
+		t.Errorf("unexpected log output: %s", got)
+	}
+}
+
+func TestSensitiveArgs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"php/Dockerfile": "FROM alpine\n",
+		"php/docker-matrix.yml": "multiply:\n" +
+			"  VERSION: [\"8.3\"]\n" +
+			"  NPM_TOKEN: [\"\"]\n" +
+			"sensitive_args: [NPM_TOKEN]\n",
+		"node/Dockerfile": "FROM alpine\n",
+		"node/docker-matrix.yml": "multiply:\n" +
+			"  NPM_TOKEN: [\"${SENSITIVE_ARGS_TOKEN}\"]\n" +
+			"sensitive_args: [NPM_TOKEN]\n",
+	})
+	chdir(t, dir)
+	t.Setenv("SENSITIVE_ARGS_TOKEN", "npm-secret-value")
+
+	builds, err := (&Parser{}).Expand("php")
+	if err != nil || len(builds) != 1 || builds[0].Tag != "8.3" {
+		t.Fatalf("unexpected builds %v: %v", builds, err)
+	}
+
+	// the value would be pushed as part of the tag
+	_, err = (&Parser{}).Expand("node")
+	if err == nil || !strings.Contains(err.Error(), "sensitive argument NPM_TOKEN") {
+		t.Fatalf("expected a sensitive argument in the tag to fail, got %v", err)
+	}
+	if strings.Contains(err.Error(), "npm-secret-value") {
+		t.Errorf("error contains the secret: %s", err)
+	}
+	if got := secrets.Redact("npm-secret-value"); got != redactMask {
+		t.Errorf("sensitive argument not masked: %q", got)
+	}
+}
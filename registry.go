@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestMediaTypes are accepted when fetching manifests
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type (
+	// RegistryClient talks to the docker registry v2 api
+	RegistryClient struct {
+		client      *http.Client
+		credentials map[string]Credential
+		insecure    map[string]bool
+
+		mu     sync.Mutex
+		tokens map[string]string
+	}
+
+	// Reference is a parsed image reference, i.e. `host/ns/name:tag`
+	Reference struct {
+		Host       string
+		Repository string
+		Tag        string
+	}
+
+	// Manifest is a fetched image manifest or image index
+	Manifest struct {
+		MediaType string
+		Digest    string
+		Body      []byte
+	}
+
+	// imageConfig contains the fields of the image config that are used
+	imageConfig struct {
+		Created time.Time `json:"created"`
+		Config  struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+
+	// manifestContent contains the fields of manifests and indexes required
+	// to copy them
+	manifestContent struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+		Manifests []struct {
+			Digest    string `json:"digest"`
+			MediaType string `json:"mediaType"`
+		} `json:"manifests"`
+	}
+)
+
+// registry is the registry api client, set up in main
+var registry *RegistryClient
+
+// NewRegistryClient creates a registry client. Hosts in insecure, and
+// localhost, are contacted via plain http.
+func NewRegistryClient(credentials map[string]Credential, insecure []string) *RegistryClient {
+	insecureHosts := map[string]bool{}
+	for _, host := range insecure {
+		insecureHosts[normalizeHost(host)] = true
+	}
+	return &RegistryClient{
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		credentials: credentials,
+		insecure:    insecureHosts,
+		tokens:      map[string]string{},
+	}
+}
+
+// ParseReference parses an image reference, the tag defaults to `latest`
+func ParseReference(ref string) (Reference, error) {
+	host := registryHost(ref)
+	name := ref
+	if strings.HasPrefix(ref, host+"/") {
+		name = strings.TrimPrefix(ref, host+"/")
+	} else if first, rest, found := strings.Cut(ref, "/"); found && normalizeHost(first) == host {
+		name = rest
+	}
+
+	tag := "latest"
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	if name == "" || tag == "" {
+		return Reference{}, fmt.Errorf("invalid image reference %q", ref)
+	}
+	if host == defaultRegistryHost && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return Reference{Host: host, Repository: name, Tag: tag}, nil
+}
+
+// String returns the reference in `host/repository:tag` form
+func (r Reference) String() string {
+	return fmt.Sprintf("%s/%s:%s", r.Host, r.Repository, r.Tag)
+}
+
+// Exists checks if the tag exists in the registry
+func (r *RegistryClient) Exists(ctx context.Context, ref Reference) (bool, error) {
+	resp, err := r.do(ctx, http.MethodHead, ref.Host, r.path(ref.Repository, "manifests", ref.Tag), nil, map[string]string{
+		"Accept": strings.Join(manifestMediaTypes, ", "),
+	}, pullScope(ref.Repository))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to check %s: %s", ref, resp.Status)
+}
+
+// Manifest fetches the manifest of ref, ref.Tag may also be a digest
+func (r *RegistryClient) Manifest(ctx context.Context, ref Reference) (*Manifest, error) {
+	resp, err := r.do(ctx, http.MethodGet, ref.Host, r.path(ref.Repository, "manifests", ref.Tag), nil, map[string]string{
+		"Accept": strings.Join(manifestMediaTypes, ", "),
+	}, pullScope(ref.Repository))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest %s: %w", ref, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch manifest %s: %s", ref, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+	return &Manifest{
+		MediaType: strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]),
+		Digest:    digest,
+		Body:      body,
+	}, nil
+}
+
+// PutManifest uploads a manifest as ref, ref.Tag may also be a digest
+func (r *RegistryClient) PutManifest(ctx context.Context, ref Reference, manifest *Manifest) error {
+	resp, err := r.do(ctx, http.MethodPut, ref.Host, r.path(ref.Repository, "manifests", ref.Tag), manifest.Body, map[string]string{
+		"Content-Type": manifest.MediaType,
+	}, pushScope(ref.Repository))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to put manifest %s: %s", ref, resp.Status)
+	}
+	return nil
+}
+
+// Blob fetches a blob, i.e. an image config
+func (r *RegistryClient) Blob(ctx context.Context, host, repository, digest string) ([]byte, error) {
+	resp, err := r.do(ctx, http.MethodGet, host, r.path(repository, "blobs", digest), nil, nil, pullScope(repository))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch blob %s from %s: %s", digest, repository, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Labels returns the labels of the image config. For an image index the
+// labels of the first image are returned.
+func (r *RegistryClient) Labels(ctx context.Context, ref Reference) (map[string]string, error) {
+	config, err := r.imageConfig(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return config.Config.Labels, nil
+}
+
+// Created returns the creation time of the image. For an image index the
+// time of the first image is returned.
+func (r *RegistryClient) Created(ctx context.Context, ref Reference) (time.Time, error) {
+	config, err := r.imageConfig(ctx, ref)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return config.Created, nil
+}
+
+// imageConfig fetches the image config of ref, for an image index the config
+// of the first image
+func (r *RegistryClient) imageConfig(ctx context.Context, ref Reference) (*imageConfig, error) {
+	manifest, err := r.Manifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	var content manifestContent
+	err = json.Unmarshal(manifest.Body, &content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest %s: %w", ref, err)
+	}
+	if len(content.Manifests) > 0 {
+		child := Reference{Host: ref.Host, Repository: ref.Repository, Tag: content.Manifests[0].Digest}
+		return r.imageConfig(ctx, child)
+	}
+	body, err := r.Blob(ctx, ref.Host, ref.Repository, content.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	config := &imageConfig{}
+	err = json.Unmarshal(body, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse image config of %s: %w", ref, err)
+	}
+	return config, nil
+}
+
+// Digest returns the manifest digest of ref
+func (r *RegistryClient) Digest(ctx context.Context, ref Reference) (string, error) {
+	resp, err := r.do(ctx, http.MethodHead, ref.Host, r.path(ref.Repository, "manifests", ref.Tag), nil, map[string]string{
+		"Accept": strings.Join(manifestMediaTypes, ", "),
+	}, pullScope(ref.Repository))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to fetch digest of %s: %s", ref, resp.Status)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	manifest, err := r.Manifest(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest, nil
+}
+
+// Tags lists all tags of the repository, a missing repository has no tags
+func (r *RegistryClient) Tags(ctx context.Context, host, repository string) ([]string, error) {
+	tags := []string{}
+	path := r.path(repository, "tags", "list") + "?n=1000"
+	for path != "" {
+		resp, err := r.do(ctx, http.MethodGet, host, path, nil, nil, pullScope(repository))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return tags, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to list tags of %s/%s: %s", host, repository, resp.Status)
+		}
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode tags of %s/%s: %w", host, repository, err)
+		}
+		tags = append(tags, list.Tags...)
+		path = nextLink(resp.Header.Get("Link"))
+	}
+	return tags, nil
+}
+
+// Delete deletes the manifest with the digest ref.Tag, the registry removes
+// all tags pointing to it
+func (r *RegistryClient) Delete(ctx context.Context, ref Reference) error {
+	resp, err := r.do(ctx, http.MethodDelete, ref.Host, r.path(ref.Repository, "manifests", ref.Tag), nil, nil, deleteScope(ref.Repository))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to delete %s: %s", ref, resp.Status)
+	}
+	return nil
+}
+
+// MountBlob makes a blob from the repository from available in repository
+// without uploading it again. Blobs that already exist are skipped.
+func (r *RegistryClient) MountBlob(ctx context.Context, host, repository, from, digest string) error {
+	resp, err := r.do(ctx, http.MethodHead, host, r.path(repository, "blobs", digest), nil, nil, pushScope(repository))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	query := url.Values{"mount": {digest}, "from": {from}}
+	resp, err = r.do(ctx, http.MethodPost, host, r.path(repository, "blobs", "uploads/")+"?"+query.Encode(), nil, nil, pushScope(repository), pullScope(from))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unable to mount %s from %s to %s: %s", digest, from, repository, resp.Status)
+	}
+	return nil
+}
+
+// Copy copies the manifest of src to dst. Both must be on the same registry,
+// the blobs are mounted if the repositories differ.
+func (r *RegistryClient) Copy(ctx context.Context, src, dst Reference) error {
+	if src.Host != dst.Host {
+		return fmt.Errorf("unable to copy %s to %s: different registries", src, dst)
+	}
+	manifest, err := r.Manifest(ctx, src)
+	if err != nil {
+		return err
+	}
+	err = r.copyContent(ctx, src, dst, manifest)
+	if err != nil {
+		return err
+	}
+	return r.PutManifest(ctx, dst, manifest)
+}
+
+// copyContent makes everything referenced by manifest available in the dst
+// repository
+func (r *RegistryClient) copyContent(ctx context.Context, src, dst Reference, manifest *Manifest) error {
+	if src.Repository == dst.Repository {
+		return nil
+	}
+	var content manifestContent
+	err := json.Unmarshal(manifest.Body, &content)
+	if err != nil {
+		return fmt.Errorf("unable to parse manifest %s: %w", src, err)
+	}
+
+	// image index, copy all child manifests by digest
+	for _, child := range content.Manifests {
+		childSrc := Reference{Host: src.Host, Repository: src.Repository, Tag: child.Digest}
+		childDst := Reference{Host: dst.Host, Repository: dst.Repository, Tag: child.Digest}
+		childManifest, err := r.Manifest(ctx, childSrc)
+		if err != nil {
+			return err
+		}
+		err = r.copyContent(ctx, childSrc, childDst, childManifest)
+		if err != nil {
+			return err
+		}
+		err = r.PutManifest(ctx, childDst, childManifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	// image manifest, mount config and layers
+	blobs := []string{}
+	if content.Config.Digest != "" {
+		blobs = append(blobs, content.Config.Digest)
+	}
+	for _, layer := range content.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	for _, digest := range blobs {
+		err := r.MountBlob(ctx, dst.Host, dst.Repository, src.Repository, digest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path builds the api path for a repository
+func (r *RegistryClient) path(repository, kind, ref string) string {
+	return fmt.Sprintf("/v2/%s/%s/%s", repository, kind, ref)
+}
+
+// baseURL returns the api url of a registry host
+func (r *RegistryClient) baseURL(host string) string {
+	scheme := "https"
+	hostname, _, _ := strings.Cut(host, ":")
+	if r.insecure[host] || hostname == "localhost" || hostname == "127.0.0.1" {
+		scheme = "http"
+	}
+	if host == defaultRegistryHost {
+		host = "registry-1.docker.io"
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// do sends an authenticated request, on a 401 the token for the scopes is
+// fetched and the request is repeated once
+func (r *RegistryClient) do(ctx context.Context, method, host, path string, body []byte, headers map[string]string, scopes ...string) (*http.Response, error) {
+	tokenKey := host + " " + strings.Join(scopes, " ")
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, r.baseURL(host)+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		r.mu.Lock()
+		auth := r.tokens[tokenKey]
+		r.mu.Unlock()
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return r.client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach %s: %w", host, err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	auth, err := r.authorize(ctx, host, resp.Header.Get("WWW-Authenticate"), scopes)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.tokens[tokenKey] = auth
+	r.mu.Unlock()
+
+	resp, err = send()
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach %s: %w", host, err)
+	}
+	return resp, nil
+}
+
+// authorize answers an authentication challenge and returns the value for
+// the Authorization header
+func (r *RegistryClient) authorize(ctx context.Context, host, challenge string, scopes []string) (string, error) {
+	cred, hasCred := r.credentials[host]
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCred {
+			return "", fmt.Errorf("registry %s requires credentials", host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(cred.Username, cred.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge from %s: %q", host, challenge)
+	}
+
+	values := parseChallenge(params)
+	query := url.Values{}
+	if service := values["service"]; service != "" {
+		query.Set("service", service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, values["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm from %s: %w", host, err)
+	}
+	if hasCred {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch token for %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to fetch token for %s: %s", host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode token for %s: %w", host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	secrets.Add(token.Token)
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses the parameters of a WWW-Authenticate header, i.e.
+// `realm="https://auth.docker.io/token",service="registry.docker.io"`
+func parseChallenge(params string) map[string]string {
+	values := map[string]string{}
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(params, "=")
+		key = strings.TrimSpace(key)
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+			params = strings.TrimPrefix(params, ",")
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		values[strings.ToLower(key)] = value
+	}
+	return values
+}
+
+// nextLink returns the path of the next page from a Link header, i.e.
+// `</v2/images/php/tags/list?last=8.3&n=1000>; rel="next"`
+func nextLink(header string) string {
+	link, _, found := strings.Cut(header, ";")
+	if !found || !strings.Contains(header, `rel="next"`) {
+		return ""
+	}
+	next, err := url.Parse(strings.Trim(strings.TrimSpace(link), "<>"))
+	if err != nil {
+		return ""
+	}
+	return next.RequestURI()
+}
+
+func pullScope(repository string) string {
+	return fmt.Sprintf("repository:%s:pull", repository)
+}
+
+func pushScope(repository string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repository)
+}
+
+func deleteScope(repository string) string {
+	return fmt.Sprintf("repository:%s:delete", repository)
+}
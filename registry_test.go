@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry is a minimal in-memory registry v2 stand-in with token
+// authentication
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string]map[string]bool
+	configs   map[string]string
+	manifests map[string]map[string]string
+	types     map[string]string
+	mounts    int
+	deletes   int
+	server    *httptest.Server
+
+	// heads counts the digest lookups, delay slows them down to observe
+	// the parallel lookups in maxHeads
+	heads    int
+	inHeads  int
+	maxHeads int
+	delay    time.Duration
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     map[string]map[string]bool{},
+		configs:   map[string]string{},
+		manifests: map[string]map[string]string{},
+		types:     map[string]string{},
+	}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// addImage stores an image manifest referencing a config and a layer blob
+func (r *fakeRegistry) addImage(repository, tag, content string) string {
+	return r.addImageAt(repository, tag, content, time.Time{})
+}
+
+// addImageAt stores an image created at the time
+func (r *fakeRegistry) addImageAt(repository, tag, content string, created time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	configContent := fmt.Sprintf(`{"created":%q,"config":{"Labels":{"content":%q}}}`, created.Format(time.RFC3339), content)
+	config := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(configContent)))
+	r.configs[config] = configContent
+	layer := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("layer"+content)))
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = map[string]bool{}
+	}
+	r.blobs[repository][config] = true
+	r.blobs[repository][layer] = true
+	manifest := fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q},"layers":[{"digest":%q}]}`, config, layer)
+	r.putManifest(repository, tag, manifest, "application/vnd.oci.image.manifest.v1+json")
+	return manifest
+}
+
+func (r *fakeRegistry) putManifest(repository, ref, manifest, mediaType string) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]string{}
+	}
+	r.manifests[repository][ref] = manifest
+	r.manifests[repository][digest] = manifest
+	r.types[digest] = mediaType
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		fmt.Fprint(w, `{"token":"secret-token"}`)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer secret-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if req.Method == http.MethodHead {
+		r.mu.Lock()
+		r.heads++
+		r.inHeads++
+		r.maxHeads = max(r.maxHeads, r.inHeads)
+		r.mu.Unlock()
+		time.Sleep(r.delay)
+		defer func() {
+			r.mu.Lock()
+			r.inHeads--
+			r.mu.Unlock()
+		}()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := r.tags(repository)
+		last := req.URL.Query().Get("last")
+		// small pages to exercise the pagination
+		n, _ := strconv.Atoi(req.URL.Query().Get("n"))
+		if n == 0 || n > 3 {
+			n = 3
+		}
+		page := []string{}
+		for _, tag := range tags {
+			if tag > last && len(page) < n {
+				page = append(page, tag)
+			}
+		}
+		if len(page) == n && page[n-1] != tags[len(tags)-1] {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?last=%s&n=%d>; rel="next"`, repository, page[n-1], n))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": page})
+	case strings.Contains(path, "/manifests/"):
+		repository, ref, _ := strings.Cut(path, "/manifests/")
+		switch req.Method {
+		case http.MethodDelete:
+			manifest, found := r.manifests[repository][ref]
+			if !found || !strings.HasPrefix(ref, "sha256:") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			for tag, other := range r.manifests[repository] {
+				if other == manifest {
+					delete(r.manifests[repository], tag)
+				}
+			}
+			r.deletes++
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodGet, http.MethodHead:
+			manifest, found := r.manifests[repository][ref]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+			w.Header().Set("Content-Type", r.types[digest])
+			w.Header().Set("Docker-Content-Digest", digest)
+			if req.Method == http.MethodGet {
+				fmt.Fprint(w, manifest)
+			}
+		case http.MethodPut:
+			body, _ := io.ReadAll(req.Body)
+			var missing bool
+			for blob := range r.referencedBlobs(string(body)) {
+				if !r.blobs[repository][blob] {
+					missing = true
+				}
+			}
+			if missing {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.putManifest(repository, ref, string(body), req.Header.Get("Content-Type"))
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.Contains(path, "/blobs/uploads/"):
+		repository, _, _ := strings.Cut(path, "/blobs/uploads/")
+		digest := req.URL.Query().Get("mount")
+		from := req.URL.Query().Get("from")
+		if !r.blobs[from][digest] {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if r.blobs[repository] == nil {
+			r.blobs[repository] = map[string]bool{}
+		}
+		r.blobs[repository][digest] = true
+		r.mounts++
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		repository, digest, _ := strings.Cut(path, "/blobs/")
+		if !r.blobs[repository][digest] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, r.configs[digest])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// tags returns the sorted tags of the repository
+func (r *fakeRegistry) tags(repository string) []string {
+	tags := []string{}
+	for ref := range r.manifests[repository] {
+		if !strings.HasPrefix(ref, "sha256:") {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// referencedBlobs returns the blob digests of a fake manifest
+func (r *fakeRegistry) referencedBlobs(manifest string) map[string]bool {
+	blobs := map[string]bool{}
+	for _, part := range strings.Split(manifest, `"digest":"`)[1:] {
+		digest, _, _ := strings.Cut(part, `"`)
+		if _, isManifest := r.types[digest]; !isManifest {
+			blobs[digest] = true
+		}
+	}
+	return blobs
+}
+
+func TestRegistryClientCopy(t *testing.T) {
+	fake := newFakeRegistry(t)
+	manifest := fake.addImage("images/php", "8.3-alpine", "php")
+	client := NewRegistryClient(nil, nil)
+
+	src, err := ParseReference(fake.host() + "/images/php:8.3-alpine")
+	if err != nil {
+		t.Fatalf("unable to parse reference: %s", err)
+	}
+	retag := Reference{Host: fake.host(), Repository: "images/php", Tag: "8.3-alpine-7"}
+	other := Reference{Host: fake.host(), Repository: "mirror/php", Tag: "8.3-alpine"}
+
+	for _, dst := range []Reference{retag, other} {
+		err = client.Copy(context.Background(), src, dst)
+		if err != nil {
+			t.Fatalf("unable to copy %s to %s: %s", src, dst, err)
+		}
+		got, err := client.Manifest(context.Background(), dst)
+		if err != nil {
+			t.Fatalf("unable to fetch %s: %s", dst, err)
+		}
+		if string(got.Body) != manifest {
+			t.Errorf("manifest mismatch for %s: %s", dst, got.Body)
+		}
+	}
+	if fake.mounts != 2 {
+		t.Errorf("expected config and layer to be mounted, got %d mounts", fake.mounts)
+	}
+}
+
+func TestRegistryClientExists(t *testing.T) {
+	fake := newFakeRegistry(t)
+	fake.addImage("images/php", "8.3-alpine", "php")
+	client := NewRegistryClient(nil, nil)
+
+	for tag, want := range map[string]bool{"8.3-alpine": true, "8.2-alpine": false} {
+		got, err := client.Exists(context.Background(), Reference{Host: fake.host(), Repository: "images/php", Tag: tag})
+		if err != nil {
+			t.Fatalf("unable to check %s: %s", tag, err)
+		}
+		if got != want {
+			t.Errorf("exists %s: want %t, got %t", tag, want, got)
+		}
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	for ref, want := range map[string]Reference{
+		"localhost:5000/images/php:8.3":  {Host: "localhost:5000", Repository: "images/php", Tag: "8.3"},
+		"docker.io/bitsbeats/image1:7.2": {Host: "docker.io", Repository: "bitsbeats/image1", Tag: "7.2"},
+		"bitsbeats/image1":               {Host: "docker.io", Repository: "bitsbeats/image1", Tag: "latest"},
+		"alpine:3.20":                    {Host: "docker.io", Repository: "library/alpine", Tag: "3.20"},
+	} {
+		got, err := ParseReference(ref)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", ref, err)
+		}
+		if got != want {
+			t.Errorf("parse %s: want %+v, got %+v", ref, want, got)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportOutputLimit is the maximal size of the output of a failed build in
+// the markdown report, the end of the output is kept
+const reportOutputLimit = 16 * 1024
+
+type (
+	// droneCard is the content of DRONE_CARD_PATH, the data is rendered
+	// with the adaptive card template in schema
+	droneCard struct {
+		Schema string    `json:"schema"`
+		Data   *cardData `json:"data"`
+	}
+
+	// cardData is the template data of card.json
+	cardData struct {
+		Summary string       `json:"summary"`
+		Images  []*cardImage `json:"images"`
+	}
+
+	// cardImage contains the builds of an image
+	cardImage struct {
+		Name   string       `json:"name"`
+		Builds []*cardBuild `json:"builds"`
+	}
+
+	// cardBuild is a single build
+	cardBuild struct {
+		Tag      string `json:"tag"`
+		Status   string `json:"status"`
+		Duration string `json:"duration"`
+		Size     string `json:"size"`
+		Reason   string `json:"reason"`
+	}
+)
+
+// humanSize formats a size in bytes, i.e. `84.1 MB`
+func humanSize(size int64) string {
+	if size <= 0 {
+		return ""
+	}
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exp := float64(size)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "kMGTP"[exp])
+}
+
+// humanDuration formats the duration of a build, empty if it did not run
+func humanDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// markdownCell escapes text for a markdown table cell
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	return strings.ReplaceAll(text, "\n", " ")
+}
+
+// sortedResults returns the results sorted by name and tag
+func (f *Finisher) sortedResults() []*DockerBuild {
+	results := append([]*DockerBuild{}, f.results...)
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Tag < results[j].Tag
+	})
+	return results
+}
+
+// summary returns the number of builds per status as text
+func (f *Finisher) summary() string {
+	counts := map[string]int{}
+	for _, b := range f.results {
+		counts[b.status()]++
+	}
+	summary := fmt.Sprintf(
+		"%d succeeded, %d failed, %d skipped, %d canceled",
+		counts[statusSucceeded], counts[statusFailed], counts[statusSkipped], counts[statusCanceled],
+	)
+	if len(f.unselected) > 0 {
+		summary += fmt.Sprintf(", %d unchanged", len(f.unselected))
+	}
+	return summary
+}
+
+// Markdown renders a report with a table per image and the output of the
+// failed builds. Unchanged builds are only counted.
+func (f *Finisher) Markdown() string {
+	report := &strings.Builder{}
+	fmt.Fprintf(report, "## drone-docker-matrix\n\n**%s**\n", f.summary())
+
+	var failed []*DockerBuild
+	results := f.sortedResults()
+	for i, b := range results {
+		if i == 0 || results[i-1].Name != b.Name {
+			fmt.Fprintf(report, "\n### %s\n\n", b.Name)
+			fmt.Fprintf(report, "| Tag | Status | Duration | Size | Reason |\n")
+			fmt.Fprintf(report, "| --- | --- | --- | --- | --- |\n")
+		}
+		status := b.status()
+		if status != statusSucceeded {
+			// skip errors already start with the status
+			status += ": " + strings.TrimPrefix(secrets.Redact(b.Error.Error()), status+": ")
+		}
+		fmt.Fprintf(
+			report, "| %s | %s | %s | %s | %s |\n",
+			markdownCell(b.Tag), markdownCell(status), humanDuration(b.duration()),
+			humanSize(b.Size), markdownCell(b.Reason),
+		)
+		if b.status() == statusFailed {
+			failed = append(failed, b)
+		}
+	}
+
+	if len(failed) > 0 {
+		fmt.Fprintf(report, "\n### Failures\n")
+	}
+	for _, b := range failed {
+		output := truncateOutput(secrets.RedactBytes(b.Output), reportOutputLimit)
+		if output == "" {
+			output = secrets.Redact(b.Error.Error())
+		}
+		fmt.Fprintf(report, "\n<details>\n<summary>%s</summary>\n\n", b.prettyName())
+		fmt.Fprintf(report, "````\n%s\n````\n\n</details>\n", strings.TrimRight(output, "\n"))
+	}
+	return report.String()
+}
+
+// card converts the results to the data of the drone card
+func (f *Finisher) card() *droneCard {
+	data := &cardData{Summary: f.summary(), Images: []*cardImage{}}
+	for _, b := range f.sortedResults() {
+		if len(data.Images) == 0 || data.Images[len(data.Images)-1].Name != b.Name {
+			data.Images = append(data.Images, &cardImage{Name: b.Name})
+		}
+		image := data.Images[len(data.Images)-1]
+		image.Builds = append(image.Builds, &cardBuild{
+			Tag:      b.Tag,
+			Status:   b.status(),
+			Duration: humanDuration(b.duration()),
+			Size:     humanSize(b.Size),
+			Reason:   b.Reason,
+		})
+	}
+	return &droneCard{Schema: c.CardSchema, Data: data}
+}
+
+// writeCard writes the drone card to path, on `/dev/stdout` it is encoded
+// as escape sequence the drone runner picks up from the logs
+func (f *Finisher) writeCard(path string) error {
+	content, err := json.Marshal(f.card())
+	if err != nil {
+		return fmt.Errorf("unable to encode card: %w", err)
+	}
+	if path == "/dev/stdout" {
+		_, err = fmt.Fprintf(os.Stdout, "\u001B]1338;%s\u001B]0m\n", base64.StdEncoding.EncodeToString(content))
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// appendFile appends content to the file at path
+func appendFile(path, content string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WriteReports writes the markdown report to SummaryFile and
+// GITHUB_STEP_SUMMARY and the card to DRONE_CARD_PATH, if set. The card
+// requires the url of its template in CardSchema.
+func (f *Finisher) WriteReports() error {
+	markdown := f.Markdown()
+	if c.SummaryFile != "" {
+		err := os.MkdirAll(filepath.Dir(c.SummaryFile), 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create summary directory: %w", err)
+		}
+		err = os.WriteFile(c.SummaryFile, []byte(markdown), 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write summary: %w", err)
+		}
+	}
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		err := appendFile(path, markdown)
+		if err != nil {
+			return fmt.Errorf("unable to write step summary: %w", err)
+		}
+	}
+	if path := os.Getenv("DRONE_CARD_PATH"); path != "" && c.CardSchema != "" {
+		err := f.writeCard(path)
+		if err != nil {
+			return fmt.Errorf("unable to write card: %w", err)
+		}
+	}
+	return nil
+}
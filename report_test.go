@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportFinisher creates a finisher with a build of each status
+func reportFinisher() *Finisher {
+	php := resultBuild("images", "php", "8.3", nil)
+	php.Size = 84_100_000
+	php.Reason = "php/Dockerfile changed"
+	failed := resultBuild("images", "php", "8.2", errors.New("exit status 1"))
+	failed.Output = []byte("step 1/2\nnpm-secret-value | denied\n")
+	skipped := resultBuild("images", "node", "22", fmt.Errorf("%w: php:8.2 failed", errSkipped))
+	skipped.Durations = nil
+	return &Finisher{
+		results:    []*DockerBuild{php, failed, skipped},
+		unselected: []*DockerBuild{{Name: "go", Tag: "1.23"}},
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	secrets.Add("npm-secret-value")
+	want := strings.Join([]string{
+		"## drone-docker-matrix",
+		"",
+		"**1 succeeded, 1 failed, 1 skipped, 0 canceled, 1 unchanged**",
+		"",
+		"### node",
+		"",
+		"| Tag | Status | Duration | Size | Reason |",
+		"| --- | --- | --- | --- | --- |",
+		"| 22 | skipped: php:8.2 failed |  |  |  |",
+		"",
+		"### php",
+		"",
+		"| Tag | Status | Duration | Size | Reason |",
+		"| --- | --- | --- | --- | --- |",
+		"| 8.2 | failed: exit status 1 | 23s |  |  |",
+		"| 8.3 | succeeded | 23s | 84.1 MB | php/Dockerfile changed |",
+		"",
+		"### Failures",
+		"",
+		"<details>",
+		"<summary>php:8.2</summary>",
+		"",
+		"````",
+		"step 1/2",
+		"******** | denied",
+		"````",
+		"",
+		"</details>",
+		"",
+	}, "\n")
+	if got := reportFinisher().Markdown(); got != want {
+		t.Errorf("want report\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := map[int64]string{
+		0:             "",
+		999:           "999 B",
+		1000:          "1.0 kB",
+		84_100_000:    "84.1 MB",
+		2_500_000_000: "2.5 GB",
+	}
+	for size, want := range tests {
+		if got := humanSize(size); got != want {
+			t.Errorf("%d: want %q, got %q", size, want, got)
+		}
+	}
+	if got := humanDuration(1234 * time.Millisecond); got != "1.2s" {
+		t.Errorf("unexpected duration %q", got)
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	dir := t.TempDir()
+	c = config{SummaryFile: filepath.Join(dir, "reports", "summary.md")}
+	stepSummary := filepath.Join(dir, "step-summary.md")
+	cardPath := filepath.Join(dir, "card.json")
+	err := os.WriteFile(stepSummary, []byte("previous step\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITHUB_STEP_SUMMARY", stepSummary)
+	t.Setenv("DRONE_CARD_PATH", cardPath)
+
+	// without a card schema the card is skipped
+	f := reportFinisher()
+	err = f.WriteReports()
+	if err != nil {
+		t.Fatalf("unable to write reports: %s", err)
+	}
+	markdown := f.Markdown()
+	summary, _ := os.ReadFile(c.SummaryFile)
+	appended, _ := os.ReadFile(stepSummary)
+	if string(summary) != markdown || string(appended) != "previous step\n"+markdown {
+		t.Errorf("unexpected summaries\n%s\n%s", summary, appended)
+	}
+	if _, err := os.Stat(cardPath); !os.IsNotExist(err) {
+		t.Errorf("card written without schema: %v", err)
+	}
+
+	c.CardSchema = "https://cards.example.com/card.json"
+	err = f.WriteReports()
+	if err != nil {
+		t.Fatalf("unable to write reports: %s", err)
+	}
+	content, err := os.ReadFile(cardPath)
+	if err != nil {
+		t.Fatalf("card not written: %s", err)
+	}
+	card := droneCard{}
+	err = json.Unmarshal(content, &card)
+	if err != nil {
+		t.Fatalf("invalid card %s: %s", content, err)
+	}
+	if card.Schema != c.CardSchema || len(card.Data.Images) != 2 || len(card.Data.Images[1].Builds) != 2 {
+		t.Errorf("unexpected card %s", content)
+	}
+	if build := card.Data.Images[1].Builds[1]; build.Tag != "8.3" || build.Status != statusSucceeded || build.Size != "84.1 MB" {
+		t.Errorf("unexpected build %+v", build)
+	}
+}
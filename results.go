@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	statusSkipped   = "skipped"
+	statusCanceled  = "canceled"
+)
+
+type (
+	// Results is the machine readable result of a run
+	Results struct {
+		Created time.Time      `json:"created"`
+		Commit  string         `json:"commit,omitempty"`
+		TraceID string         `json:"trace_id,omitempty"`
+		Images  []*ImageResult `json:"images"`
+	}
+
+	// ImageResult is the result of a single build
+	ImageResult struct {
+		Name   string `json:"name"`
+		Tag    string `json:"tag"`
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+		// Reason explains why the image was built
+		Reason string `json:"reason,omitempty"`
+		// Reference pins the image in the registry, `name@digest`
+		Reference string             `json:"reference,omitempty"`
+		ImageID   string             `json:"image_id,omitempty"`
+		Size      int64              `json:"size,omitempty"`
+		Arguments map[string]string  `json:"arguments"`
+		Durations map[string]float64 `json:"durations"`
+		Tags      []*TagResult       `json:"tags"`
+	}
+
+	// TagResult is a pushed tag of a build
+	TagResult struct {
+		Tag       string `json:"tag"`
+		Digest    string `json:"digest,omitempty"`
+		Reference string `json:"reference,omitempty"`
+	}
+)
+
+// status classifies the result of the build
+func (b *DockerBuild) status() string {
+	switch {
+	case b.Error == nil:
+		return statusSucceeded
+	case errors.Is(b.Error, errSkipped):
+		return statusSkipped
+	case isCanceled(b.Error):
+		return statusCanceled
+	}
+	return statusFailed
+}
+
+// duration returns the total duration of all stages
+func (b *DockerBuild) duration() (total time.Duration) {
+	for _, duration := range b.Durations {
+		total += duration
+	}
+	return total
+}
+
+// digestReference returns `name@digest` for the tag, empty without digest
+func digestReference(tag, digest string) string {
+	if digest == "" {
+		return ""
+	}
+	ref, err := ParseReference(tag)
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSuffix(tag, ":"+ref.Tag)
+	return fmt.Sprintf("%s@%s", name, digest)
+}
+
+// result converts the build to its machine readable result, sensitive
+// arguments are masked
+func (b *DockerBuild) result() *ImageResult {
+	result := &ImageResult{
+		Name:      b.Name,
+		Tag:       b.Tag,
+		Status:    b.status(),
+		Reason:    b.Reason,
+		ImageID:   b.ImageID,
+		Size:      b.Size,
+		Arguments: map[string]string{},
+		Durations: map[string]float64{},
+		Tags:      []*TagResult{},
+	}
+	if b.Error != nil {
+		result.Error = secrets.Redact(b.Error.Error())
+	}
+	for key, value := range b.Arguments {
+		result.Arguments[key] = secrets.Redact(value)
+	}
+	for stage, duration := range b.Durations {
+		result.Durations[stage] = duration.Seconds()
+	}
+	// the image in the registry is preferred over additional names
+	primary := c.Registry + "/"
+	for _, tag := range b.tags() {
+		digest := b.Digests[tag]
+		reference := digestReference(tag, digest)
+		if reference != "" && (result.Reference == "" || strings.HasPrefix(tag, primary) && !strings.HasPrefix(result.Reference, primary)) {
+			result.Reference = reference
+		}
+		result.Tags = append(result.Tags, &TagResult{
+			Tag:       tag,
+			Digest:    digest,
+			Reference: reference,
+		})
+	}
+	return result
+}
+
+// WriteResults writes the results of all builds as json to path
+func (f *Finisher) WriteResults(path string) error {
+	results := Results{
+		Created: c.Time,
+		Commit:  commitSHA(),
+		TraceID: tracer.TraceID(),
+		Images:  []*ImageResult{},
+	}
+	for _, b := range f.results {
+		results.Images = append(results.Images, b.result())
+	}
+	sort.Slice(results.Images, func(i, j int) bool {
+		if results.Images[i].Name != results.Images[j].Name {
+			return results.Images[i].Name < results.Images[j].Name
+		}
+		return results.Images[i].Tag < results.Images[j].Tag
+	})
+
+	content, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode results: %w", err)
+	}
+	err = writeFileAtomic(path, append(content, '\n'))
+	if err != nil {
+		return fmt.Errorf("unable to write results: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resultBuild creates a build of the image with durations of both stages
+func resultBuild(namespace, name, tag string, err error) *DockerBuild {
+	return &DockerBuild{
+		Namespace: namespace,
+		Name:      name,
+		Tag:       tag,
+		Error:     err,
+		Durations: map[string]time.Duration{"build": 3 * time.Second, "upload": 20 * time.Second},
+		Attempts:  map[string]int{"build": 2},
+	}
+}
+
+// setResultConfig configures the registry and the time of the run
+func setResultConfig(t *testing.T) {
+	oldConfig := c
+	t.Cleanup(func() { c = oldConfig })
+	c = config{
+		Registry:  "registry.example.com",
+		TagName:   "latest",
+		TagPolicy: defaultTagPolicy(t),
+		Time:      time.Unix(1714564800, 0),
+	}
+	setDroneEnv(t, map[string]string{})
+}
+
+func TestBuildStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, statusSucceeded},
+		{errors.New("exit status 1"), statusFailed},
+		{fmt.Errorf("%w: php:8.3 failed", errSkipped), statusSkipped},
+		{fmt.Errorf("build %w", context.Canceled), statusCanceled},
+		{fmt.Errorf("%w: exit status 1", context.DeadlineExceeded), statusCanceled},
+	}
+	for _, test := range tests {
+		b := &DockerBuild{Error: test.err}
+		if got := b.status(); got != test.want {
+			t.Errorf("%v: want %s, got %s", test.err, test.want, got)
+		}
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	setResultConfig(t)
+	c.Commit = strings.Repeat("a", 40)
+	digest := "sha256:" + strings.Repeat("1", 64)
+	mirrorDigest := "sha256:" + strings.Repeat("2", 64)
+
+	php := resultBuild("images", "php", "8.3", nil)
+	php.AdditionalNames = []string{"mirror.example.com/php"}
+	php.Arguments = map[string]string{"VERSION": "8.3"}
+	php.Digests = map[string]string{
+		"mirror.example.com/php:8.3":          mirrorDigest,
+		"registry.example.com/images/php:8.3": digest,
+	}
+	node := resultBuild("images", "node", "22", fmt.Errorf("%w: node:22", errSkipped))
+	f := &Finisher{results: []*DockerBuild{php, node}}
+
+	path := filepath.Join(t.TempDir(), "results", "results.json")
+	err := f.WriteResults(path)
+	if err != nil {
+		t.Fatalf("unable to write results: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := Results{}
+	err = json.Unmarshal(content, &results)
+	if err != nil {
+		t.Fatalf("invalid results %s: %s", content, err)
+	}
+	if results.Commit != strings.Repeat("a", 40) || !results.Created.Equal(c.Time) || len(results.Images) != 2 {
+		t.Fatalf("unexpected results %s", content)
+	}
+
+	if image := results.Images[0]; image.Name != "node" || image.Status != statusSkipped || image.Reference != "" {
+		t.Errorf("unexpected result of node %+v", image)
+	}
+	image := results.Images[1]
+	if image.Name != "php" || image.Status != statusSucceeded || image.Durations["upload"] != 20 {
+		t.Errorf("unexpected result of php %+v", image)
+	}
+	// the digest of the registry is preferred over additional names
+	if want := "registry.example.com/images/php@" + digest; image.Reference != want {
+		t.Errorf("want reference %s, got %s", want, image.Reference)
+	}
+	if len(image.Tags) != 2 || image.Tags[0].Reference != "mirror.example.com/php@"+mirrorDigest {
+		t.Errorf("unexpected tags %s", content)
+	}
+
+	// the result file is replaced, no temporary files are left
+	err = f.WriteResults(path)
+	if err != nil {
+		t.Fatalf("unable to replace results: %s", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("unexpected files in the result directory %v %v", entries, err)
+	}
+}
+
+func TestDigestReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("1", 64)
+	tests := map[[2]string]string{
+		{"registry.example.com/images/php:8.3", digest}: "registry.example.com/images/php@" + digest,
+		{"localhost:5000/images/php:8.3", digest}:       "localhost:5000/images/php@" + digest,
+		{"registry.example.com/images/php:8.3", ""}:     "",
+	}
+	for test, want := range tests {
+		if got := digestReference(test[0], test[1]); got != want {
+			t.Errorf("%v: want %s, got %s", test, want, got)
+		}
+	}
+}
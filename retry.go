@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultRetryPatterns match output of temporary failures
+var defaultRetryPatterns = []string{
+	`(?i)\b(500 internal server error|502 bad gateway|503 service unavailable|504 gateway time-?out)\b`,
+	`(?i)received unexpected http status: 5\d\d`,
+	`(?i)(i/o timeout|timed out|timeout exceeded|deadline exceeded)`,
+	`(?i)tls handshake (timeout|error)`,
+	`(?i)connection (reset by peer|refused)`,
+	`(?i)temporary failure (in name resolution|resolving)`,
+	`(?i)unexpected EOF`,
+}
+
+type (
+	// RetryPolicy describes how often and when a failed step is repeated
+	RetryPolicy struct {
+		// Attempts is the maximal number of attempts, 1 disables retries
+		Attempts int
+		// Backoff is the delay before the first retry, it doubles with
+		// each attempt up to MaxBackoff
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+		// Jitter randomizes the delay by the fraction, i.e. 0.2 is ±20%
+		Jitter float64
+
+		// ExitCodes and Patterns classify retryable errors, a failure
+		// is retried if the exit code or the output matches
+		ExitCodes map[int]bool
+		Patterns  []*regexp.Regexp
+	}
+)
+
+// buildRetry and uploadRetry are the policies of the build and upload
+// stages, set up in main
+var (
+	buildRetry  = &RetryPolicy{Attempts: 1}
+	uploadRetry = &RetryPolicy{Attempts: 1}
+)
+
+// NewRetryPolicy creates a retry policy, patterns are added to
+// defaultRetryPatterns
+func NewRetryPolicy(attempts int, backoff, maxBackoff time.Duration, jitter float64, exitCodes []int, patterns []string) (*RetryPolicy, error) {
+	p := &RetryPolicy{
+		Attempts:   attempts,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		Jitter:     jitter,
+		ExitCodes:  map[int]bool{},
+	}
+	for _, code := range exitCodes {
+		p.ExitCodes[code] = true
+	}
+	for _, pattern := range append(defaultRetryPatterns, patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.Patterns = append(p.Patterns, re)
+	}
+	return p, nil
+}
+
+// splitLines returns the non-empty lines of value without surrounding
+// whitespace
+func splitLines(value string) (lines []string) {
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Retryable checks if the failure is temporary. Errors from starting the
+// command are never retried.
+func (p *RetryPolicy) Retryable(err error, output []byte) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	if p.ExitCodes[exitErr.ExitCode()] {
+		return true
+	}
+	for _, pattern := range p.Patterns {
+		if pattern.Match(output) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the backoff before the given retry, starting with 1
+func (p *RetryPolicy) Delay(retry int) time.Duration {
+	delay := float64(p.Backoff) * math.Pow(2, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Do runs fn until it succeeds, the failure is not retryable or all attempts
+// are used. The number of attempts is recorded on the build for the stage.
+func (p *RetryPolicy) Do(ctx context.Context, b *DockerBuild, stage string, fn func() ([]byte, error)) (err error) {
+	if b.Attempts == nil {
+		b.Attempts = map[string]int{}
+	}
+	for attempt := 1; ; attempt++ {
+		var output []byte
+		output, err = fn()
+		if attempt > b.Attempts[stage] {
+			b.Attempts[stage] = attempt
+		}
+		if err == nil || ctx.Err() != nil || attempt >= p.Attempts || !p.Retryable(err, output) {
+			return err
+		}
+		delay := p.Delay(attempt)
+		log.Warnf("Retrying       %s %s in %s (attempt %d/%d): %s", b.prettyName(), stage, delay.Round(time.Second), attempt+1, p.Attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// exitError returns the error of a command exiting with code
+func exitError(t *testing.T, code string) error {
+	err := exec.Command("sh", "-c", "exit "+code).Run()
+	if err == nil {
+		t.Fatalf("expected exit code %s", code)
+	}
+	return err
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy, err := NewRetryPolicy(3, time.Millisecond, 0, 0, []int{75}, splitLines("\n  (?i)quota .{1,3} exceeded  \n\n"))
+	if err != nil {
+		t.Fatalf("unable to create policy: %s", err)
+	}
+	errStart := errors.New("executable file not found")
+
+	tests := []struct {
+		name     string
+		err      error
+		output   string
+		attempts int
+	}{
+		{"success", nil, "", 1},
+		{"exit code", exitError(t, "75"), "", 3},
+		{"default pattern", exitError(t, "1"), "dial tcp: i/o timeout", 3},
+		{"custom pattern", exitError(t, "1"), "QUOTA was exceeded", 3},
+		{"permanent", exitError(t, "1"), "unknown instruction: FORM", 1},
+		{"not started", errStart, "i/o timeout", 1},
+	}
+	for _, test := range tests {
+		b := &DockerBuild{Name: "php", Tag: "8.3"}
+		calls := 0
+		err := policy.Do(context.Background(), b, "build", func() ([]byte, error) {
+			calls++
+			return []byte(test.output), test.err
+		})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: want error %v, got %v", test.name, test.err, err)
+		}
+		if calls != test.attempts || b.Attempts["build"] != test.attempts {
+			t.Errorf("%s: want %d attempts, got %d calls and %d recorded", test.name, test.attempts, calls, b.Attempts["build"])
+		}
+	}
+}
+
+func TestRetryPolicyDoSucceedsOnRetry(t *testing.T) {
+	policy := &RetryPolicy{Attempts: 5, Backoff: time.Millisecond, ExitCodes: map[int]bool{1: true}}
+	b := &DockerBuild{}
+	failure := exitError(t, "1")
+	calls := 0
+	err := policy.Do(context.Background(), b, "upload", func() ([]byte, error) {
+		calls++
+		if calls < 2 {
+			return nil, failure
+		}
+		return nil, nil
+	})
+	if err != nil || calls != 2 || b.Attempts["upload"] != 2 {
+		t.Errorf("want success after 2 attempts, got %v after %d", err, calls)
+	}
+}
+
+func TestRetryPolicyDoCanceled(t *testing.T) {
+	policy := &RetryPolicy{Attempts: 5, Backoff: time.Hour, ExitCodes: map[int]bool{1: true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	failure := exitError(t, "1")
+	calls := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err := policy.Do(ctx, &DockerBuild{}, "build", func() ([]byte, error) {
+		calls++
+		return nil, failure
+	})
+	if err != failure || calls != 1 {
+		t.Errorf("want the failure of the first attempt, got %v after %d", err, calls)
+	}
+	if time.Since(start) > time.Minute {
+		t.Errorf("backoff was not interrupted")
+	}
+
+	// a canceled context is never retried
+	calls = 0
+	_ = policy.Do(ctx, &DockerBuild{}, "build", func() ([]byte, error) {
+		calls++
+		return nil, failure
+	})
+	if calls != 1 {
+		t.Errorf("want 1 attempt after cancel, got %d", calls)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	delays := []time.Duration{}
+	for retry := 1; retry <= 5; retry++ {
+		delays = append(delays, policy.Delay(retry))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(delays, want) {
+		t.Errorf("want %v, got %v", want, delays)
+	}
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(10)
+		if delay < 4*time.Second || delay > 6*time.Second {
+			t.Fatalf("delay %s is outside of the jitter", delay)
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	got := splitLines("a{1,3}\n\n  b,c  \r\n")
+	want := []string{"a{1,3}", "b,c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
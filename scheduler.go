@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// scheduleRank orders the builds of the queue: higher priorities first,
+	// then builds with more levels of dependents, then the longest expected
+	// duration
+	scheduleRank struct {
+		priority int
+		depth    int
+		duration time.Duration
+	}
+
+	// scheduledBuild is a build waiting for a slot
+	scheduledBuild struct {
+		build *DockerBuild
+		rank  scheduleRank
+		// arrival keeps the order of builds with the same rank
+		arrival int
+		ready   chan struct{}
+	}
+
+	// Scheduler hands out the slots of a pool. Waiting builds get a free
+	// slot in the order of their rank instead of their arrival. Without
+	// ranks the builds are started in the order they arrive.
+	Scheduler struct {
+		mu       sync.Mutex
+		free     int
+		ranks    map[*DockerBuild]scheduleRank
+		waiting  []*scheduledBuild
+		arrivals int
+		// fairShare limits the slots used by the builds of one image while
+		// builds of other images wait, 0 disables the limit
+		fairShare int
+		running   map[string]int
+	}
+)
+
+// NewScheduler creates a scheduler with size slots
+func NewScheduler(size int, ranks map[*DockerBuild]scheduleRank, fairShare int) *Scheduler {
+	return &Scheduler{
+		free:      size,
+		ranks:     ranks,
+		fairShare: fairShare,
+		running:   map[string]int{},
+	}
+}
+
+// rankBuilds ranks the builds by their priority, dependency depth and
+// expected duration per `name:tag`. Builds without an expected duration are
+// expected to take the average.
+func rankBuilds(builds []*DockerBuild, depths map[*DockerBuild]int, expected map[string]time.Duration) map[*DockerBuild]scheduleRank {
+	var average time.Duration
+	known := 0
+	for _, b := range builds {
+		if duration, found := expected[b.prettyName()]; found {
+			average += duration
+			known++
+		}
+	}
+	if known > 0 {
+		average /= time.Duration(known)
+	}
+
+	ranks := make(map[*DockerBuild]scheduleRank, len(builds))
+	for _, b := range builds {
+		duration, found := expected[b.prettyName()]
+		if !found {
+			duration = average
+		}
+		ranks[b] = scheduleRank{priority: b.Priority, depth: depths[b], duration: duration}
+	}
+	return ranks
+}
+
+// before compares the rank of two builds
+func (r scheduleRank) before(other scheduleRank) bool {
+	if r.priority != other.priority {
+		return r.priority > other.priority
+	}
+	if r.depth != other.depth {
+		return r.depth > other.depth
+	}
+	return r.duration > other.duration
+}
+
+// sortBuilds orders the builds by their rank, builds with the same rank
+// keep their order
+func sortBuilds(builds []*DockerBuild, ranks map[*DockerBuild]scheduleRank) {
+	sort.SliceStable(builds, func(i, j int) bool {
+		return ranks[builds[i]].before(ranks[builds[j]])
+	})
+	for _, b := range builds {
+		rank := ranks[b]
+		log.Debugf("Queued         %s priority %d, depth %d, expected %s", b.prettyName(), rank.priority, rank.depth, rank.duration.Round(time.Second))
+	}
+}
+
+// Acquire blocks until the build got a slot. If ctx is canceled first the
+// build leaves the queue and the cause is returned, the build holds no slot.
+// A nil scheduler does not limit the builds.
+func (s *Scheduler) Acquire(ctx context.Context, b *DockerBuild) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	waiting := &scheduledBuild{
+		build:   b,
+		rank:    s.ranks[b],
+		arrival: s.arrivals,
+		ready:   make(chan struct{}),
+	}
+	s.arrivals++
+	s.waiting = append(s.waiting, waiting)
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-waiting.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.waiting {
+		if other == waiting {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return context.Cause(ctx)
+		}
+	}
+	// the slot was handed out while ctx was canceled
+	return nil
+}
+
+// Release frees the slot of the build
+func (s *Scheduler) Release(b *DockerBuild) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free++
+	s.running[b.Name]--
+	s.dispatch()
+}
+
+// dispatch hands out the free slots, the lock must be held. The best ranked
+// build of an image below its fair share is started first. If all waiting
+// images exhausted their share the best ranked build is started anyway, so
+// no slot is left idle.
+func (s *Scheduler) dispatch() {
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+		if a.rank != b.rank {
+			return a.rank.before(b.rank)
+		}
+		return a.arrival < b.arrival
+	})
+	for s.free > 0 && len(s.waiting) > 0 {
+		next := 0
+		if s.fairShare > 0 {
+			for i, waiting := range s.waiting {
+				if s.running[waiting.build.Name] < s.fairShare {
+					next = i
+					break
+				}
+			}
+		}
+		waiting := s.waiting[next]
+		s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+		s.free--
+		s.running[waiting.build.Name]++
+		close(waiting.ready)
+	}
+}
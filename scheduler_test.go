@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runScheduler queues the builds while all slots are taken by the blockers
+// and returns the order the builds get a slot in
+func runScheduler(t *testing.T, s *Scheduler, blockers, builds []*DockerBuild) []string {
+	for _, b := range blockers {
+		s.Acquire(context.Background(), b)
+	}
+	started := make(chan *DockerBuild)
+	for _, b := range builds {
+		go func(b *DockerBuild) {
+			s.Acquire(context.Background(), b)
+			started <- b
+		}(b)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s.mu.Lock()
+		queued := len(s.waiting)
+		s.mu.Unlock()
+		if queued == len(builds) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d builds queued", queued, len(builds))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// each release hands the slot to exactly one waiting build
+	order := []string{}
+	holders := append([]*DockerBuild{}, blockers...)
+	for range builds {
+		s.Release(holders[0])
+		b := <-started
+		order = append(order, b.prettyName())
+		holders = append(holders[1:], b)
+	}
+	for _, b := range holders {
+		s.Release(b)
+	}
+	return order
+}
+
+func TestScheduler(t *testing.T) {
+	php := &DockerBuild{Name: "php", Tag: "8.3"}
+	node := &DockerBuild{Name: "node", Tag: "22"}
+	base := &DockerBuild{Name: "base", Tag: "latest"}
+	urgent := &DockerBuild{Name: "urgent", Tag: "latest", Priority: 1}
+	builds := []*DockerBuild{php, node, base, urgent}
+
+	depths := map[*DockerBuild]int{base: 2}
+	expected := map[string]time.Duration{"php:8.3": time.Minute, "node:22": 3 * time.Minute}
+	ranks := rankBuilds(builds, depths, expected)
+	if ranks[base].duration != 2*time.Minute {
+		t.Errorf("expected the average for unknown durations, got %s", ranks[base].duration)
+	}
+
+	sorted := append([]*DockerBuild{}, builds...)
+	sortBuilds(sorted, ranks)
+	want := []*DockerBuild{urgent, base, node, php}
+	if !reflect.DeepEqual(sorted, want) {
+		t.Errorf("unexpected order %v", sorted)
+	}
+
+	order := runScheduler(t, NewScheduler(1, ranks, 0), []*DockerBuild{{Name: "blocker"}}, builds)
+	wantOrder := []string{"urgent:latest", "base:latest", "node:22", "php:8.3"}
+	if !reflect.DeepEqual(order, wantOrder) {
+		t.Errorf("want %v, got %v", wantOrder, order)
+	}
+}
+
+func TestSchedulerFairShare(t *testing.T) {
+	blockers := []*DockerBuild{{Name: "matrix", Tag: "1"}, {Name: "matrix", Tag: "2"}}
+	builds := []*DockerBuild{{Name: "matrix", Tag: "3"}, {Name: "matrix", Tag: "4"}, {Name: "other", Tag: "1"}}
+	expected := map[string]time.Duration{"matrix:3": 11 * time.Minute, "matrix:4": 10 * time.Minute, "other:1": time.Minute}
+	ranks := rankBuilds(builds, nil, expected)
+
+	tests := []struct {
+		fairShare int
+		want      []string
+	}{
+		{0, []string{"matrix:3", "matrix:4", "other:1"}},
+		{1, []string{"other:1", "matrix:3", "matrix:4"}},
+	}
+	for _, test := range tests {
+		order := runScheduler(t, NewScheduler(2, ranks, test.fairShare), blockers, builds)
+		if !reflect.DeepEqual(order, test.want) {
+			t.Errorf("fair share %d: want %v, got %v", test.fairShare, test.want, order)
+		}
+	}
+}
+
+func TestSchedulerAcquireCanceled(t *testing.T) {
+	s := NewScheduler(1, nil, 0)
+	blocker := &DockerBuild{Name: "php", Tag: "8.3"}
+	err := s.Acquire(context.Background(), blocker)
+	if err != nil {
+		t.Fatalf("unable to acquire a free slot: %s", err)
+	}
+
+	// a canceled build leaves the queue without a slot
+	ctx, cancel := context.WithCancelCause(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- s.Acquire(ctx, &DockerBuild{Name: "node", Tag: "22"})
+	}()
+	cause := errors.New("terminated")
+	time.Sleep(10 * time.Millisecond)
+	cancel(cause)
+	select {
+	case err = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire was not canceled")
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("want cause %s, got %v", cause, err)
+	}
+	s.mu.Lock()
+	waiting := len(s.waiting)
+	s.mu.Unlock()
+	if waiting != 0 {
+		t.Errorf("canceled build still waiting")
+	}
+
+	// the slot is handed to the next build
+	s.Release(blocker)
+	err = s.Acquire(context.Background(), &DockerBuild{Name: "go", Tag: "1.23"})
+	if err != nil || s.free != 0 || s.running["node"] != 0 {
+		t.Errorf("unexpected state after release: %v, %d free, running %v", err, s.free, s.running)
+	}
+
+	// without a scheduler the builds are not limited
+	var unlimited *Scheduler
+	if err := unlimited.Acquire(ctx, blocker); err != nil {
+		t.Errorf("unexpected error without scheduler: %s", err)
+	}
+	unlimited.Release(blocker)
+}
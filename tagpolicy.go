@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventPullRequest = "pull_request"
+	eventTag         = "tag"
+	eventBranch      = "branch"
+	eventDefault     = "default"
+
+	// versionMarker replaces the git tag when rendering release patterns
+	versionMarker = "0version0"
+	// versionPattern matches the git tag in release patterns
+	versionPattern = `v?[0-9]+(\.[0-9]+)+(-[0-9A-Za-z_.-]*)?`
+)
+
+var (
+	invalidTagChars  = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	invalidSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+	// parsedTemplates caches the parsed tag, label and annotation
+	// templates by their text
+	parsedTemplates sync.Map
+)
+
+type (
+	// TagPolicy contains the tag templates per event. The templates have
+	// access to TagData.
+	TagPolicy struct {
+		// PullRequest is used for pull requests
+		PullRequest []string `envconfig:"PULL_REQUEST" yaml:"pull_request" default:"pr-{{.PullRequest}}-{{.Tag}}"`
+		// Branch is used for pushes to other branches than the default
+		// branch
+		Branch []string `envconfig:"BRANCH" yaml:"branch" default:"{{.Tag}}"`
+		// Tag is used for git tags
+		Tag []string `envconfig:"TAG" yaml:"tag" default:"{{.Tag}},{{.Tag}}-{{.Version}}"`
+		// Default is used for pushes to the default branch and all other
+		// events
+		Default []string `envconfig:"DEFAULT" yaml:"default" default:"{{.Tag}}"`
+		// Latest lists the events that may tag `as_latest` as latest
+		Latest []string `envconfig:"LATEST" yaml:"latest" default:"default,tag"`
+	}
+
+	// TagData is available in the tag templates
+	TagData struct {
+		// Tag is the tag from the matrix, i.e. `8.3-alpine`
+		Tag         string
+		PullRequest string
+		Branch      string
+		// BranchSlug is the branch lowercased with all special
+		// characters replaced by `-`
+		BranchSlug string
+		// GitTag is the git tag and Version the git tag without a
+		// leading `v`
+		GitTag  string
+		Version string
+	}
+)
+
+// currentEvent determines the tag policy event from the drone environment
+func currentEvent() string {
+	event := os.Getenv("DRONE_BUILD_EVENT")
+	branch := os.Getenv("DRONE_BRANCH")
+	switch {
+	case event == "pull_request" || os.Getenv("DRONE_PULL_REQUEST") != "":
+		return eventPullRequest
+	case event == "tag" || os.Getenv("DRONE_TAG") != "":
+		return eventTag
+	case branch != "" && branch != defaultBranch():
+		return eventBranch
+	}
+	return eventDefault
+}
+
+// slug converts text to a lowercase tag component
+func slug(text string) string {
+	return strings.Trim(invalidSlugChars.ReplaceAllString(strings.ToLower(text), "-"), "-")
+}
+
+// Merge returns a copy of the policy with all non-empty fields of override
+func (p TagPolicy) Merge(override *TagPolicy) TagPolicy {
+	if override == nil {
+		return p
+	}
+	if len(override.PullRequest) > 0 {
+		p.PullRequest = override.PullRequest
+	}
+	if len(override.Branch) > 0 {
+		p.Branch = override.Branch
+	}
+	if len(override.Tag) > 0 {
+		p.Tag = override.Tag
+	}
+	if len(override.Default) > 0 {
+		p.Default = override.Default
+	}
+	if override.Latest != nil {
+		p.Latest = override.Latest
+	}
+	return p
+}
+
+// parseTemplate returns the parsed template, each text is only parsed once
+func parseTemplate(text string) (*template.Template, error) {
+	if tmpl, found := parsedTemplates.Load(text); found {
+		return tmpl.(*template.Template), nil
+	}
+	tmpl, err := template.New("template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	parsedTemplates.Store(text, tmpl)
+	return tmpl, nil
+}
+
+// Validate parses all templates of the policy and renders them with
+// example data, so invalid templates fail before the first build
+func (p TagPolicy) Validate() error {
+	data := TagData{
+		Tag:         "latest",
+		PullRequest: "1",
+		Branch:      "main",
+		BranchSlug:  "main",
+		GitTag:      "v1.0.0",
+		Version:     "1.0.0",
+	}
+	for _, event := range []string{eventPullRequest, eventBranch, eventTag, eventDefault} {
+		for _, text := range p.templates(event) {
+			tmpl, err := parseTemplate(text)
+			if err != nil {
+				return fmt.Errorf("invalid %s tag template %q: %w", event, text, err)
+			}
+			err = tmpl.Execute(&bytes.Buffer{}, data)
+			if err != nil {
+				return fmt.Errorf("invalid %s tag template %q: %w", event, text, err)
+			}
+		}
+	}
+	for _, event := range p.Latest {
+		if !knownEvent(event) {
+			return fmt.Errorf("unknown latest event %q", event)
+		}
+	}
+	return nil
+}
+
+// knownEvent checks if event is one of the tag policy events
+func knownEvent(event string) bool {
+	switch event {
+	case eventPullRequest, eventBranch, eventTag, eventDefault:
+		return true
+	}
+	return false
+}
+
+// templates returns the templates for the event
+func (p TagPolicy) templates(event string) []string {
+	switch event {
+	case eventPullRequest:
+		return p.PullRequest
+	case eventBranch:
+		return p.Branch
+	case eventTag:
+		return p.Tag
+	}
+	return p.Default
+}
+
+// Apply renders the tags for the matrix tag. Invalid characters are replaced
+// and duplicates removed, without templates the tag is used as it is.
+func (p TagPolicy) Apply(event, tag string) []string {
+	return renderTags(p.templates(event), tagData(tag))
+}
+
+// ReleasePatterns returns regular expressions matching the tags of git tag
+// builds of the matrix tag for any version, i.e. `8\.3-v?[0-9]+...` for
+// `{{.Tag}}-{{.Version}}`. Git tags need to look like a version with at
+// least two parts.
+func (p TagPolicy) ReleasePatterns(tag string) (patterns []string) {
+	data := tagData(tag)
+	data.GitTag = versionMarker
+	data.Version = versionMarker
+	for _, rendered := range renderTags(p.templates(eventTag), data) {
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(rendered), versionMarker, versionPattern)
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// tagData returns the template data for the matrix tag from the drone
+// environment
+func tagData(tag string) TagData {
+	gitTag := os.Getenv("DRONE_TAG")
+	return TagData{
+		Tag:         tag,
+		PullRequest: os.Getenv("DRONE_PULL_REQUEST"),
+		Branch:      os.Getenv("DRONE_BRANCH"),
+		BranchSlug:  slug(os.Getenv("DRONE_BRANCH")),
+		GitTag:      gitTag,
+		Version:     strings.TrimPrefix(gitTag, "v"),
+	}
+}
+
+// renderTags renders the templates with the data
+func renderTags(templates []string, data TagData) (tags []string) {
+	if len(templates) == 0 {
+		templates = []string{"{{.Tag}}"}
+	}
+	seen := map[string]bool{}
+	for _, text := range templates {
+		tmpl, err := parseTemplate(text)
+		if err != nil {
+			log.Errorf("Invalid tag template %q: %s", text, err)
+			continue
+		}
+		buffer := &bytes.Buffer{}
+		err = tmpl.Execute(buffer, data)
+		if err != nil {
+			log.Errorf("Unable to render tag template %q: %s", text, err)
+			continue
+		}
+		rendered := strings.Trim(invalidTagChars.ReplaceAllString(buffer.String(), "-"), "-.")
+		if len(rendered) > 128 {
+			rendered = rendered[:128]
+		}
+		if rendered == "" || seen[rendered] {
+			continue
+		}
+		seen[rendered] = true
+		tags = append(tags, rendered)
+	}
+	return tags
+}
+
+// AllowsLatest checks if images may be tagged as latest for the event,
+// without a configuration the default branch and git tags may
+func (p TagPolicy) AllowsLatest(event string) bool {
+	if p.Latest == nil {
+		return event == eventDefault || event == eventTag
+	}
+	for _, allowed := range p.Latest {
+		if allowed == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// defaultTagPolicy returns the policy with the defaults of the environment
+func defaultTagPolicy(t *testing.T) TagPolicy {
+	policy := TagPolicy{}
+	err := envconfig.Process("tag_policy_test", &policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// setDroneEnv sets the drone variables of an event, all others are empty
+func setDroneEnv(t *testing.T, env map[string]string) {
+	for _, name := range []string{"DRONE_BUILD_EVENT", "DRONE_PULL_REQUEST", "DRONE_TAG", "DRONE_BRANCH", "DRONE_REPO_BRANCH"} {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestTagPolicyEvents(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c.DefaultBranch = "main"
+	policy := defaultTagPolicy(t)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		event string
+		want  []string
+	}{
+		{
+			"default branch",
+			map[string]string{"DRONE_BUILD_EVENT": "push", "DRONE_BRANCH": "main"},
+			eventDefault, []string{"8.3-alpine"},
+		},
+		{
+			"pull request",
+			map[string]string{"DRONE_BUILD_EVENT": "pull_request", "DRONE_PULL_REQUEST": "42", "DRONE_BRANCH": "main"},
+			eventPullRequest, []string{"pr-42-8.3-alpine"},
+		},
+		{
+			"branch",
+			map[string]string{"DRONE_BUILD_EVENT": "push", "DRONE_BRANCH": "Feature/New_PHP"},
+			eventBranch, []string{"8.3-alpine"},
+		},
+		{
+			"tag",
+			map[string]string{"DRONE_BUILD_EVENT": "tag", "DRONE_TAG": "v1.2.0"},
+			eventTag, []string{"8.3-alpine", "8.3-alpine-1.2.0"},
+		},
+		{
+			"cron",
+			map[string]string{"DRONE_BUILD_EVENT": "cron", "DRONE_BRANCH": "main"},
+			eventDefault, []string{"8.3-alpine"},
+		},
+	}
+	for _, test := range tests {
+		setDroneEnv(t, test.env)
+		event := currentEvent()
+		if event != test.event {
+			t.Errorf("%s: want event %s, got %s", test.name, test.event, event)
+		}
+		if got := policy.Apply(event, "8.3-alpine"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %v, got %v", test.name, test.want, got)
+		}
+	}
+
+	// branches are kept apart with the slug of the branch
+	setDroneEnv(t, map[string]string{"DRONE_BUILD_EVENT": "push", "DRONE_BRANCH": "Feature/New_PHP"})
+	policy.Branch = []string{"{{.Tag}}-{{.BranchSlug}}"}
+	if got := policy.Apply(eventBranch, "8.3-alpine"); !reflect.DeepEqual(got, []string{"8.3-alpine-feature-new-php"}) {
+		t.Errorf("unexpected branch tags %v", got)
+	}
+
+	latest := map[string]bool{eventDefault: true, eventTag: true, eventBranch: false, eventPullRequest: false}
+	for event, want := range latest {
+		if policy.AllowsLatest(event) != want {
+			t.Errorf("latest for %s: want %t", event, want)
+		}
+	}
+}
+
+func TestTagPolicyApply(t *testing.T) {
+	setDroneEnv(t, map[string]string{"DRONE_BRANCH": "main"})
+	policy := TagPolicy{Default: []string{"{{.Tag}}", "{{.Tag}}", "{{.Branch}}/{{.Tag}}", "-"}}
+	want := []string{"8.3", "main-8.3"}
+	if got := policy.Apply(eventDefault, "8.3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := (TagPolicy{}).Apply(eventTag, "8.3"); !reflect.DeepEqual(got, []string{"8.3"}) {
+		t.Errorf("without templates the tag is used as it is, got %v", got)
+	}
+}
+
+func TestTagPolicyMerge(t *testing.T) {
+	policy := TagPolicy{
+		PullRequest: []string{"pr"},
+		Branch:      []string{"branch"},
+		Tag:         []string{"tag"},
+		Default:     []string{"default"},
+		Latest:      []string{eventDefault},
+	}
+	if got := policy.Merge(nil); !reflect.DeepEqual(got, policy) {
+		t.Errorf("merging nil changed the policy: %v", got)
+	}
+
+	merged := policy.Merge(&TagPolicy{Branch: []string{"{{.Tag}}-dev"}, Latest: []string{}})
+	want := policy
+	want.Branch = []string{"{{.Tag}}-dev"}
+	want.Latest = []string{}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("want %v, got %v", want, merged)
+	}
+	if merged.AllowsLatest(eventDefault) {
+		t.Errorf("an empty latest list must disable latest")
+	}
+	if !reflect.DeepEqual(policy.Branch, []string{"branch"}) {
+		t.Errorf("merge modified the original policy")
+	}
+}
+
+func TestTagPolicyValidate(t *testing.T) {
+	if err := defaultTagPolicy(t).Validate(); err != nil {
+		t.Errorf("the default policy is invalid: %s", err)
+	}
+	tests := []struct {
+		policy TagPolicy
+		error  string
+	}{
+		{TagPolicy{Default: []string{"{{.Tag"}}, "invalid default tag template"},
+		{TagPolicy{Branch: []string{"{{.Unknown}}"}}, "invalid branch tag template"},
+		{TagPolicy{Tag: []string{"{{.Tag | nope}}"}}, "invalid tag tag template"},
+		{TagPolicy{Latest: []string{"release"}}, "unknown latest event"},
+	}
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%+v: want error %q, got %v", test.policy, test.error, err)
+		}
+	}
+
+	// templates are parsed once
+	text := "{{.Tag}}-cached"
+	first, err := parseTemplate(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := parseTemplate(text)
+	if first != second {
+		t.Errorf("template was parsed again")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// traceLabel stores the trace id of the run that built the image
+	traceLabel = "com.github.bitsbeats.docker-matrix.trace-id"
+
+	// traceServiceName is the service name of the exported spans
+	traceServiceName = "drone-docker-matrix"
+
+	// otlpTracesPath is appended to the endpoint if missing
+	otlpTracesPath = "/v1/traces"
+
+	// otlp span kinds and status codes
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+type (
+	// Tracer collects the spans of a run, all spans share the trace id.
+	// The spans are exported at the end of the run via OTLP/HTTP json or
+	// to a file. A nil tracer disables tracing.
+	Tracer struct {
+		traceID  string
+		endpoint string
+		file     string
+		headers  map[string]string
+
+		mu    sync.Mutex
+		spans []*Span
+	}
+
+	// Span is a timed operation of the run, attributes may be set from
+	// several goroutines
+	Span struct {
+		tracer   *Tracer
+		id       string
+		parentID string
+		name     string
+		start    time.Time
+
+		mu         sync.Mutex
+		end        time.Time
+		attributes map[string]string
+		err        error
+	}
+
+	// spanContextKey stores the current span in a context
+	spanContextKey struct{}
+
+	// otlpTraces is the body of an OTLP/HTTP json export request
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// tracer traces the run, set up in main if an endpoint or file is
+// configured
+var tracer *Tracer
+
+// randomID returns a random hex encoded id of size bytes
+func randomID(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// NewTracer creates a tracer with a new trace id. The endpoint is the base
+// url of the collector, headers are `key=value` pairs sent with the export.
+func NewTracer(endpoint, file string, headers []string) (*Tracer, error) {
+	t := &Tracer{
+		traceID:  randomID(16),
+		endpoint: endpoint,
+		file:     file,
+		headers:  map[string]string{},
+	}
+	if endpoint != "" && !strings.HasSuffix(endpoint, otlpTracesPath) {
+		t.endpoint = strings.TrimSuffix(endpoint, "/") + otlpTracesPath
+	}
+	for _, header := range headers {
+		key, value, found := strings.Cut(header, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid trace header %q, expected key=value", header)
+		}
+		secrets.Add(value)
+		t.headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return t, nil
+}
+
+// TraceID returns the trace id of the run, empty if tracing is disabled
+func (t *Tracer) TraceID() string {
+	if t == nil {
+		return ""
+	}
+	return t.traceID
+}
+
+// Start starts a span as child of the span in ctx, attributes are key value
+// pairs. The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, attributes ...string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:     t,
+		id:         randomID(8),
+		name:       name,
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.parentID = parent.id
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.attributes[attributes[i]] = attributes[i+1]
+	}
+	return contextWithSpan(ctx, span), span
+}
+
+// contextWithSpan returns a context carrying span
+func contextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// spanFromContext returns the current span, nil if there is none
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// SetAttribute adds an attribute to the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// End finishes the span, a non nil err marks the span as failed
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// otlp converts the span to the OTLP json format
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           s.tracer.traceID,
+		SpanID:            s.id,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attributes),
+		Status:            otlpStatus{Code: otlpStatusOk},
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: secrets.Redact(s.err.Error())}
+	}
+	return span
+}
+
+// otlpAttributes converts attributes in a stable order
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	converted := make([]otlpAttribute, 0, len(attributes))
+	for _, key := range sortedKeys(attributes) {
+		converted = append(converted, otlpAttribute{
+			Key:   key,
+			Value: otlpValue{StringValue: secrets.Redact(attributes[key])},
+		})
+	}
+	return converted
+}
+
+// export encodes all finished spans as OTLP json
+func (t *Tracer) export() ([]byte, error) {
+	t.mu.Lock()
+	sort.SliceStable(t.spans, func(i, j int) bool {
+		return t.spans[i].start.Before(t.spans[j].start)
+	})
+	spans := make([]otlpSpan, 0, len(t.spans))
+	for _, span := range t.spans {
+		spans = append(spans, span.otlp())
+	}
+	t.mu.Unlock()
+
+	resource := map[string]string{"service.name": traceServiceName}
+	for key, env := range map[string]string{
+		"drone.repo":         "DRONE_REPO",
+		"drone.build.number": "DRONE_BUILD_NUMBER",
+		"drone.build.link":   "DRONE_BUILD_LINK",
+		"vcs.branch":         "DRONE_BRANCH",
+	} {
+		if value := os.Getenv(env); value != "" {
+			resource[key] = value
+		}
+	}
+	if commit := commitSHA(); commit != "" {
+		resource["vcs.commit"] = commit
+	}
+
+	return json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: otlpAttributes(resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: traceServiceName},
+				Spans: spans,
+			}},
+		}},
+	})
+}
+
+// Flush exports all finished spans to the endpoint and the file
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	content, err := t.export()
+	if err != nil {
+		return fmt.Errorf("unable to encode spans: %w", err)
+	}
+	if t.file != "" {
+		err = os.MkdirAll(filepath.Dir(t.file), 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create trace directory: %w", err)
+		}
+		err = os.WriteFile(t.file, content, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write trace file: %w", err)
+		}
+	}
+	if t.endpoint != "" {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(content))
+		if err != nil {
+			return fmt.Errorf("unable to create trace export: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range t.headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to export spans: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unable to export spans: unexpected status %s", resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// spanAttributes returns the attributes of an exported span as map
+func spanAttributes(span otlpSpan) map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range span.Attributes {
+		attributes[attribute.Key] = attribute.Value.StringValue
+	}
+	return attributes
+}
+
+func TestTracerExport(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c.Commit = "0123456789abcdef0123456789abcdef01234567"
+	t.Setenv("DRONE_REPO", "org/images")
+	received := make(chan *http.Request, 1)
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer collector.Close()
+
+	file := filepath.Join(t.TempDir(), "traces", "spans.json")
+	tr, err := NewTracer(collector.URL+"/", file, []string{"Authorization=Bearer trace-token"})
+	if err != nil {
+		t.Fatalf("unable to create tracer: %s", err)
+	}
+	ctx, run := tr.Start(context.Background(), "run", "run.mode", "build")
+	buildCtx, build := tr.Start(ctx, "build", "image.name", "php")
+	_, queue := tr.Start(buildCtx, "queue")
+	queue.End(nil)
+
+	// attributes are set concurrently by the stages of the build
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			build.SetAttribute("attempt."+strconv.Itoa(i), "Bearer trace-token")
+		}(i)
+	}
+	wg.Wait()
+	build.SetAttribute("image.status", statusFailed)
+	build.End(errors.New("exit status 1"))
+	run.End(nil)
+
+	err = tr.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("unable to flush spans: %s", err)
+	}
+	req := <-received
+	if req.URL.Path != otlpTracesPath || req.Header.Get("Authorization") != "Bearer trace-token" {
+		t.Errorf("unexpected export %s with headers %v", req.URL.Path, req.Header)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil || string(content) != string(body) {
+		t.Errorf("trace file differs from the export: %v", err)
+	}
+
+	traces := otlpTraces{}
+	err = json.Unmarshal(body, &traces)
+	if err != nil || len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("invalid export %s: %v", body, err)
+	}
+	resource := traces.ResourceSpans[0].Resource
+	if attributes := spanAttributes(otlpSpan{Attributes: resource.Attributes}); attributes["service.name"] != traceServiceName ||
+		attributes["drone.repo"] != "org/images" || attributes["vcs.commit"] == "" {
+		t.Errorf("unexpected resource %v", attributes)
+	}
+	spans := map[string]otlpSpan{}
+	for _, span := range traces.ResourceSpans[0].ScopeSpans[0].Spans {
+		if span.TraceID != tr.TraceID() {
+			t.Errorf("span %s not part of the trace", span.Name)
+		}
+		spans[span.Name] = span
+	}
+	if len(spans) != 3 {
+		t.Fatalf("want 3 spans, got %v", spans)
+	}
+
+	// the spans are nested as started from the contexts
+	if spans["run"].ParentSpanID != "" || spans["build"].ParentSpanID != spans["run"].SpanID ||
+		spans["queue"].ParentSpanID != spans["build"].SpanID {
+		t.Errorf("unexpected parents %v", spans)
+	}
+	attributes := spanAttributes(spans["build"])
+	if len(attributes) != 12 || attributes["image.name"] != "php" || attributes["image.status"] != statusFailed {
+		t.Errorf("unexpected attributes %v", attributes)
+	}
+	if attributes["attempt.3"] != redactMask {
+		t.Errorf("secret in attribute: %s", attributes["attempt.3"])
+	}
+	if status := spans["build"].Status; status.Code != otlpStatusError || status.Message != "exit status 1" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status := spans["run"].Status; status.Code != otlpStatusOk {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestTracerDisabled(t *testing.T) {
+	var disabled *Tracer
+	ctx, span := disabled.Start(context.Background(), "run")
+	span.SetAttribute("key", "value")
+	span.End(nil)
+	if spanFromContext(ctx) != nil || disabled.TraceID() != "" || disabled.Flush(ctx) != nil {
+		t.Errorf("disabled tracer recorded a span")
+	}
+	_, err := NewTracer("http://localhost:4318", "", []string{"invalid"})
+	if err == nil {
+		t.Errorf("expected an error for an invalid header")
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 )
 
 type (
@@ -11,28 +14,62 @@ type (
 		input   <-chan *DockerBuild
 		output  chan<- *DockerBuild
 		handler BuildHandler
+
+		// canceler cancels remaining builds after a failure
+		canceler *Canceler
+		// deps delays builds until their base images are finished
+		deps *Dependencies
+		// scheduler hands out the slots of the pool
+		scheduler *Scheduler
 	}
 )
 
 // pool is a wrapper that allows to process a chain in a pool. It consumes all
 // builds from `input` calls `handler` on them, decremts their wg and puts the
-// build in `ouput`
-func (w *Worker) pool(size int) {
-	p := make(chan bool, size)
-	for i := 0; i < size; i++ {
-		p <- true
-	}
-
+// build in `ouput`. Builds wait for their dependencies before taking a slot
+// of the scheduler. Once ctx is canceled the handler is no longer called and
+// the builds are passed on with an error.
+func (w *Worker) pool(ctx context.Context) {
 	defer w.wg.Done()
 	for b := range w.input {
 		w.wg.Add(1)
-		lock := <-p
-		go func(build *DockerBuild, lock bool) {
+		go func(build *DockerBuild) {
 			defer w.wg.Done()
-			w.handler(build)
-			p <- lock
+			buildCtx := w.canceler.Context(ctx, build)
+			buildCtx, span := tracer.Start(contextWithSpan(buildCtx, build.span), w.name)
+			events.EmitBuild(eventQueued, build, &Event{Stage: w.name})
+			_, waitSpan := tracer.Start(buildCtx, "queue")
+			depErr := w.deps.Wait(buildCtx, build)
+			queued := time.Now()
+			acquired := w.scheduler.Acquire(buildCtx, build) == nil
+			build.setWait(w.name, time.Since(queued))
+			waitSpan.End(depErr)
+			if depErr != nil && build.Error == nil {
+				build.Error = depErr
+			} else if buildCtx.Err() == nil {
+				failed := build.Error != nil
+				start := time.Now()
+				events.EmitBuild(eventStarted, build, &Event{Stage: w.name})
+				w.handler(buildCtx, build)
+				build.setDuration(w.name, time.Since(start))
+				events.EmitBuild(eventFinished, build, &Event{
+					Stage:    w.name,
+					Status:   build.status(),
+					Error:    errorText(build.Error),
+					Duration: time.Since(start).Seconds(),
+				})
+				if !failed {
+					w.canceler.Failed(build)
+				}
+			} else if build.Error == nil {
+				build.Error = fmt.Errorf("%s %w", w.name, context.Cause(buildCtx))
+			}
+			if acquired {
+				w.scheduler.Release(build)
+			}
+			span.End(build.Error)
 			w.output <- build
-		}(b, lock)
+		}(b)
 	}
 }
 
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// runWorker passes the builds through a build worker
+func runWorker(ctx context.Context, builds ...*DockerBuild) []*DockerBuild {
+	input := make(chan *DockerBuild, len(builds))
+	output := make(chan *DockerBuild, len(builds))
+	w := &Worker{
+		name:    "build",
+		wg:      &sync.WaitGroup{},
+		input:   input,
+		output:  output,
+		handler: builder,
+	}
+	for _, b := range builds {
+		input <- b
+	}
+	close(input)
+	w.wg.Add(1)
+	go w.pool(ctx)
+	w.WaitAndClose()
+
+	done := []*DockerBuild{}
+	for b := range output {
+		done = append(done, b)
+	}
+	return done
+}
+
+func TestWorkerTimeout(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "docker")
+	err := os.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c = config{Command: script, Registry: "registry.example.com"}
+
+	// the stage of the build is stopped after its timeout
+	b := NewDockerBuild(ksuid.New(), "php", dir)
+	b.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	done := runWorker(context.Background(), b)
+	if len(done) != 1 || !errors.Is(b.Error, context.DeadlineExceeded) {
+		t.Fatalf("want a timeout of the build, got %v", b.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("build not stopped after its timeout, took %s", elapsed)
+	}
+
+	// builds of a terminated run are passed on without running
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("terminated"))
+	b = NewDockerBuild(ksuid.New(), "node", dir)
+	done = runWorker(ctx, b)
+	if len(done) != 1 || b.Error == nil || !strings.Contains(b.Error.Error(), "build terminated") {
+		t.Fatalf("want the build to be canceled, got %v", b.Error)
+	}
+}